@@ -5,4 +5,5 @@ go 1.12
 require (
 	github.com/gorilla/mux v1.7.3
 	github.com/hashicorp/vault/api v1.0.4
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 )
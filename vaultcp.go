@@ -4,237 +4,2673 @@ package main
 
 import (
 	"bufio"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/hashicorp/vault/api"
+	"golang.org/x/time/rate"
 )
 
 const maxUploadSize = 2 * 1024 * 1024 // 2 mb
 
+// Process exit codes
+const (
+	exitOK            = 0
+	exitFatal         = 1   // a setup error or an error that stopped the run
+	exitSecretsFailed = 2   // the run completed but some secrets failed (see the summary)
+	exitDifferent     = 3   // doVerify found paths that differ between the Vaults
+	exitInterrupted   = 130 // the run was interrupted by SIGINT or SIGTERM
+)
+
+// stopped is closed when a signal interrupts the run: no new work is started after that
+var stopped = make(chan struct{})
+
+// errInterrupted stops the listing and copying of an interrupted run
+var errInterrupted = errors.New("the run was interrupted")
+
+// errDifferent is returned by doAction when doVerify found paths that differ between the Vaults
+var errDifferent = errors.New("Error: the destination differs from the source (see the verify output above)")
+
+// errDeadline stops the listing and copying of a run that passed its deadline (the timeout flag)
+var errDeadline = errors.New("the run deadline (timeout) passed")
+
+// report collects the counts, phases and failures of the run for reportFile
+var report = newReport()
+
+// errSecretsFailed is returned by doAction when the run completed but some secrets failed
+var errSecretsFailed = errors.New("Error: some secrets failed (see the summary above)")
+
 var (
 	working       bool   = false
 	kvRoot        string = ""
-	kvApi         bool   = false
+	dstKvRoot     string = ""
+	kvApi         bool   = false // the source Vault uses the kv v2 api
+	dstKvApi      bool   = false // the destination Vault uses the kv v2 api
+	kvMountPath   string = ""    // the mount of kvRoot without the trailing / (like secret or team/kv)
+	dstMountPath  string = ""    // the mount of dstKvRoot without the trailing /
 	srcClients    []*api.Client
 	dstClients    []*api.Client
 	listFile      *os.File
+	journal       *os.File
+	journalDone   map[string]bool                   // "write <src path>" and "delete <dst path>" entries completed by earlier runs
+	fileMount     string                            // when set only the srcInputFile entries of this mount are read
+	dstFileKV     map[string]map[string]interface{} // the dstInputFile entries by path (nil when verifying against a Vault)
 	versionString string
+	retryCount    int64                         // number of Vault requests retried (updated atomically)
+	concurrency   *adaptiveLimiter              // limits the Vault requests in flight when adaptive is set
+	rateLimiters  map[*api.Client]*rate.Limiter // the srcRateLimit or dstRateLimit limiter of each client (none without a limit)
+	failures      []failure                     // per-secret errors of the current run
+	state         *syncState                    // loaded from stateFile (nil when not set)
+	incremental   bool                          // the current copy only copies the source secrets whose version moved (see stateFile)
+	failuresMu    sync.Mutex
+
+	// Path rewrite rules applied to the logical path (the path without the kv v2 data segment) of each source secret
+	rewriteMap      map[string]string // exact old -> new paths from rewriteMapFile
+	rewritePrefixes []rewriteRule
+	rewriteRegexes  []rewriteRule
+
+	// Path filters (split into path segments) matched against the secret path below the mount
+	includeFilters [][]string
+	excludeFilters [][]string
 
 	// flags below
-	kvRootFlag     *string
-	listenPort     *int
-	numWorkers     *int
-	version        string
-	doCopy         *bool
-	doMirror       *bool
-	srcInputFile   *string
-	srcVaultAddr   *string
-	dstVaultAddr   *string
-	srcVaultToken  *string
-	dstVaultToken  *string
-	listOutputFile *string
+	kvRootFlag        *string
+	allMounts         *bool
+	mounts            stringList
+	filters           stringList
+	dstKvRootFlag     *string
+	rewritePrefix     stringList
+	rewriteRegex      stringList
+	rewriteMapFile    *string
+	listenPort        *int
+	numWorkers        *int
+	listWorkers       *int
+	version           string
+	doCopy            *bool
+	doMirror          *bool
+	doUpdate          *bool
+	dryRun            *bool
+	copyVersions      *bool
+	withMetadata      *bool
+	planFormat        *string
+	srcInputFile      *string
+	srcInputKvVersion *int
+	srcVaultAddr      *string
+	dstVaultAddr      *string
+	srcVaultToken     *string
+	dstVaultToken     *string
+	listOutputFile    *string
+	reportFile        *string
+	gracePeriod       *time.Duration
+	listTimeout       *time.Duration
+	readTimeout       *time.Duration
+	writeTimeout      *time.Duration
+	timeout           *time.Duration
+	watch             *time.Duration
+	stateFile         *string
+	doSync            *bool
+	doVerify          *bool
+	doDiff            *bool
+	diffValues        *string
+	diffSalt          *string
+	dstInputFile      *string
+	doMerge           *bool
+	mergePrecedence   *string
+	dstInputKvVersion *int
+	syncStateFile     *string
+	conflictPolicy    *string
+	statusPort        *int
+	journalFile       *string
+	resume            *bool
+	retryMaxAttempts  *int
+	retryBaseBackoff  *time.Duration
+	retryMaxBackoff   *time.Duration
+	retryJitter       *float64
+	srcRateLimit      *float64
+	srcRateBurst      *int
+	dstRateLimit      *float64
+	dstRateBurst      *int
+	adaptive          *bool
+	minWorkers        *int
+	adaptiveLatency   *time.Duration
 )
 
-func list2(path string) (err error) {
-	srcKV := map[string]interface{}{}
-	err = list(srcClients[0], path, false, srcKV)
-	if err != nil {
-		return err
-	}
+// stringList is a flag.Value for flags that may be repeated
+type stringList []string
 
-	jobMaps := make([]map[string]interface{}, *numWorkers)
-	for i := 0; i < *numWorkers; i++ {
-		jobMaps[i] = make(map[string]interface{}, 1000)
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// kvMount is a kv secrets engine mount like secret/
+type kvMount struct {
+	Path string
+	V2   bool
+}
+
+// The listing file line that records the mount (and its kv api version) of the entries that follow it
+const mountLinePrefix = "# mount "
+
+type rewriteRule struct {
+	from string
+	re   *regexp.Regexp
+	to   string
+}
+
+// job is a unit of work for the worker pools: a secret path and, when it comes from srcInputFile, its value and metadata
+type job struct {
+	path     string
+	value    map[string]interface{}
+	metadata map[string]interface{}
+}
+
+func list2(ctx context.Context, path string) (err error) {
+	report.addMount(kvRoot, kvApi, "", false)
+	defer report.phase("list", kvRoot)()
+
+	// The listing feeds the workers as it discovers the keys; the channel bounds how far it runs ahead of them
+	jobs := make(chan job, *numWorkers)
+	var wg sync.WaitGroup
+
+	for w := 0; w < *numWorkers; w++ {
+		wg.Add(1)
+		go listWorker(ctx, w, jobs, &wg)
 	}
 
 	count := 0
-	for k, sv := range srcKV {
+	err = list(ctx, srcClients, path, kvMountPath, kvApi, false, func(k string) error {
 		count++
-		jobMaps[count%*numWorkers][k] = sv
+		jobs <- job{path: k}
+		return nil
+	})
+	close(jobs)
+	report.count("listed", count)
+
+	wg.Wait()
+
+	return err
+}
+
+/*
+ * copy streams the source entries to a pool of numWorkers workers that read, compare and write them
+ * Only the paths are held in memory: the dst paths of the source entries in doMirror mode (to find the dst entries to delete)
+ * and the source paths when there are rewrite rules (to detect collisions before anything is written)
+ */
+func copy(ctx context.Context, path, dstPath string) (err error) {
+	report.addMount(kvRoot, kvApi, dstKvRoot, dstKvApi)
+	endPhase := report.phase("copy", kvRoot)
+
+	// With stateFile only the kv v2 source secrets whose version moved are copied, and in doMirror mode the source
+	// deletions are found from the state instead of listing the dst Vault (the first run, without a state, lists it)
+	incremental = state != nil && kvApi && *srcInputFile == ""
+	if state != nil && !incremental {
+		log.Printf("Info: Copying mount %s in full (stateFile only applies to kv v2 source Vaults)\n", kvRoot)
+	}
+	stateDeletes := incremental && state.loaded && !hasRewriteRules()
+
+	var plan *Plan
+	if *dryRun {
+		plan = &Plan{Counts: map[string]int{}}
 	}
 
+	// wantKV holds the dst path of every source entry
+	wantKV := map[string]bool{}
+
+	jobs := make(chan job, *numWorkers)
+	var mu sync.Mutex
 	var wg sync.WaitGroup
 
 	for w := 0; w < *numWorkers; w++ {
 		wg.Add(1)
-		go listWorker(w, jobMaps[w], &wg)
+		if *dryRun {
+			go planWorker(ctx, w, jobs, plan, &mu, &wg)
+		} else {
+			go writeWorker(ctx, w, jobs, &wg)
+		}
 	}
 
+	count := 0
+	skipped := 0
+	err = walkSource(ctx, path, func(j job) error {
+		if err := stopErr(ctx); err != nil {
+			return err
+		}
+		count++
+		if *doMirror && !stateDeletes {
+			wantKV[rewritePath(j.path)] = true
+		}
+		if incremental {
+			state.see(j.path)
+		}
+		if journalDone["write "+j.path] {
+			skipped++
+			return nil
+		}
+		jobs <- j
+		return nil
+	})
+	close(jobs)
+
 	wg.Wait()
+	endPhase()
 
-	return err //assert nil
-}
+	if err != nil {
+		return err
+	}
 
-func copy(path string) (err error) {
-	srcKV := map[string]interface{}{}
+	report.count("listed", count)
+	report.count("journal_skipped", skipped)
+	logDetail("Info: The source Vault has %d keys\n", count)
+	if skipped > 0 {
+		log.Printf("Info: Skipped %d keys already copied by an earlier run (see journalFile)\n", skipped)
+	}
 
-	if *srcInputFile != "" {
-		err = listFromFile(srcKV)
-		if err != nil {
-			return err
+	if incremental {
+		deleted := state.deletedUnder(kvRoot)
+		if *doMirror && stateDeletes {
+			err = deleteDeleted(ctx, deleted, plan)
+			if err != nil {
+				return err
+			}
+		} else if plan == nil {
+			state.forget(deleted)
 		}
-	} else {
-		err = list(srcClients[0], path, false, srcKV)
+	}
+
+	if *doMirror && !stateDeletes {
+		err = mirrorDeletes(ctx, dstPath, wantKV, plan)
 		if err != nil {
 			return err
 		}
 	}
 
-	// TODO: determine if these are in the source Vault and if so optionally overwrite them if the data is different
-	dstKV := map[string]interface{}{}
-	err = list(dstClients[0], path, false, dstKV)
+	if *dryRun {
+		return reportPlan(plan, "plan_", planSummary(plan))
+	}
+
+	return err //assert nil
+}
+
+// walkSource calls found for each selected source entry (from the source Vault or srcInputFile) as it is listed
+// With rewrite rules the entries are collected first so that collisions fail the copy before anything is written
+func walkSource(ctx context.Context, path string, found func(j job) error) (err error) {
+	walk := func(found func(j job) error) error {
+		if *srcInputFile != "" {
+			return listFromFile(found)
+		}
+		return list(ctx, srcClients, path, kvMountPath, kvApi, false, func(k string) error {
+			return found(job{path: k})
+		})
+	}
+
+	if !hasRewriteRules() {
+		return walk(found)
+	}
+
+	var all []job
+	err = walk(func(j job) error {
+		all = append(all, j)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(all))
+	for _, j := range all {
+		paths = append(paths, j.path)
+	}
+	err = checkRewrites(paths)
 	if err != nil {
 		return err
 	}
 
-	numsrckeys := len(srcKV)
-	log.Printf("Info: The source Vault has %d keys\n", numsrckeys)
+	for _, j := range all {
+		err = found(j)
+		if err != nil {
+			return err
+		}
+	}
+	return err // nil
+}
+
+// deleteDeleted removes the dst entries of the source secrets deleted since the run that saved stateFile
+// (or adds them to the plan); deleted holds their source paths
+func deleteDeleted(ctx context.Context, deleted []string, plan *Plan) (err error) {
+	defer report.phase("mirror", dstKvRoot)()
 
-	numdstkeys := len(dstKV)
-	log.Printf("Info: The destination Vault has %d keys\n", numdstkeys)
+	deletes := make(chan job, *numWorkers)
+	var wg sync.WaitGroup
 
-	// Divide the kv entries into numWorkers so we can update the dst Vault in parallel
-	jobMaps := make([]map[string]interface{}, *numWorkers)
-	for i := 0; i < *numWorkers; i++ {
-		jobMaps[i] = make(map[string]interface{}, 1000)
+	if plan == nil {
+		for w := 0; w < *numWorkers; w++ {
+			wg.Add(1)
+			go deleteWorker(ctx, w, deletes, &wg)
+		}
 	}
 
-	count := 0
-	for k, sv := range srcKV {
-		var ok bool
-		_, ok = dstKV[k]
-		if !ok {
-			// k, v entry is missing from dst so register a job to copy it
-			log.Printf("Copying key %s from source to dest Vault (it is missing from dest)\n", k)
-			count++
-			jobMaps[count%*numWorkers][k] = sv // sv will be non nil when read from input file
+	for _, k := range deleted {
+		dk := rewritePath(k)
+		if journalDone["delete "+dk] {
+			continue
+		}
+		if plan != nil {
+			plan.add(dk, k, changeDelete)
+			continue
+		}
+		if err = stopErr(ctx); err != nil {
+			break
 		}
+		logDetail("Deleting key %s from dest Vault (it was deleted from source since the last run)\n", dk)
+		state.pendingDelete(dk, k)
+		deletes <- job{path: dk}
 	}
+	close(deletes)
+
+	wg.Wait()
+
+	logDetail("Info: %d keys were deleted from the source Vault since the last run\n", len(deleted))
+
+	return err
+}
+
+// mirrorDeletes removes the destination Vault entries that are not in the source Vault (or adds them to the plan)
+// wantKV holds the (rewritten) dst paths of the source entries
+func mirrorDeletes(ctx context.Context, dstPath string, wantKV map[string]bool, plan *Plan) (err error) {
+	defer report.phase("mirror", dstKvRoot)()
 
+	deletes := make(chan job, *numWorkers)
 	var wg sync.WaitGroup
 
+	if plan == nil {
+		for w := 0; w < *numWorkers; w++ {
+			wg.Add(1)
+			go deleteWorker(ctx, w, deletes, &wg)
+		}
+	}
+
+	count := 0
+	err = list(ctx, dstClients, dstPath, dstMountPath, dstKvApi, false, func(k string) error {
+		count++
+		if wantKV[k] || journalDone["delete "+k] {
+			return nil
+		}
+		if plan != nil {
+			plan.add(k, k, changeDelete)
+			return nil
+		}
+		// k is in dst but not in src so queue it for deletion
+		logDetail("Deleting key %s from dest Vault (it is missing from source)\n", k)
+		deletes <- job{path: k}
+		return nil
+	})
+	close(deletes)
+
+	wg.Wait()
+
+	logDetail("Info: The destination Vault has %d keys\n", count)
+
+	return err
+}
+
+// Conflict policies of doSync for the paths changed in both Vaults since the last sync
+const (
+	policyReport = "report" // only report the conflict
+	policySource = "source" // the source Vault wins
+	policyNewest = "newest" // the Vault with the newest kv v2 updated_time wins
+)
+
+// syncBase is the syncStateFile content: the hash of the data of each path (below the mount) when both Vaults
+// last agreed on it
+type syncBase struct {
+	Hashes map[string]string `json:"hashes"`
+
+	mu sync.Mutex
+}
+
+func (b *syncBase) get(rel string) (hash string, known bool) {
+	b.mu.Lock()
+	hash, known = b.Hashes[rel]
+	b.mu.Unlock()
+	return hash, known
+}
+
+// set records the agreed hash of a path; a path missing from both Vaults is forgotten
+func (b *syncBase) set(rel, hash string) {
+	b.mu.Lock()
+	if hash == "" {
+		delete(b.Hashes, rel)
+	} else {
+		b.Hashes[rel] = hash
+	}
+	b.mu.Unlock()
+}
+
+/*
+ * twoWaySync propagates the changes made in either Vault since the last sync to the other Vault
+ * A path changed in one Vault only (compared to the base saved in syncStateFile) is written or deleted in the other one;
+ * a path changed in both Vaults is a conflict that conflictPolicy resolves or that is only reported
+ * A path that is new in one Vault is copied to the other one; a path that is in both Vaults with different data
+ * and no base is a conflict
+ */
+func twoWaySync(ctx context.Context) (err error) {
+	report.addMount(kvRoot, kvApi, dstKvRoot, dstKvApi)
+	defer report.phase("sync", kvRoot)()
+
+	base := &syncBase{Hashes: map[string]string{}}
+	ba, err := ioutil.ReadFile(*syncStateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error reading sync state file %s: %s", *syncStateFile, err)
+	}
+	if err == nil {
+		err = json.Unmarshal(ba, base)
+		if err != nil {
+			return fmt.Errorf("Error reading sync state file %s: %s", *syncStateFile, err)
+		}
+	}
+	if !*dryRun {
+		defer func() {
+			base.mu.Lock()
+			ba, serr := json.Marshal(base)
+			base.mu.Unlock()
+			if serr == nil {
+				serr = writeFileAtomic(*syncStateFile, ba)
+			}
+			if serr != nil {
+				log.Printf("Error writing sync state file %s: %s\n", *syncStateFile, serr)
+				if err == nil {
+					err = serr
+				}
+			}
+		}()
+	}
+
+	// the union of the paths of both Vaults and of the base (to forget the paths deleted from both)
+	rels := map[string]bool{}
+	for rel := range base.Hashes {
+		if !hasFilters() || pathSelected(relPath(syncPath(kvRoot, rel, kvMountPath, false), kvMountPath, false)) {
+			rels[rel] = true
+		}
+	}
+	err = list(ctx, srcClients, listPath(kvRoot, kvMountPath, kvApi), kvMountPath, kvApi, false, func(k string) error {
+		rels[rootRelPath(k, kvRoot, kvMountPath, kvApi)] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = list(ctx, dstClients, listPath(dstKvRoot, dstMountPath, dstKvApi), dstMountPath, dstKvApi, false, func(k string) error {
+		rels[rootRelPath(k, dstKvRoot, dstMountPath, dstKvApi)] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logDetail("Info: The two Vaults have %d paths\n", len(rels))
+	report.count("listed", len(rels))
+
+	var plan *Plan
+	if *dryRun {
+		plan = &Plan{Counts: map[string]int{}}
+	}
+
+	jobs := make(chan job, *numWorkers)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
 	for w := 0; w < *numWorkers; w++ {
 		wg.Add(1)
-		go writeWorker(w, jobMaps[w], &wg)
+		go syncWorker(ctx, w, jobs, base, plan, &mu, &wg)
+	}
+	for rel := range rels {
+		if err = stopErr(ctx); err != nil {
+			break
+		}
+		jobs <- job{path: rel}
 	}
+	close(jobs)
 
 	wg.Wait()
 
-	return err //assert nil
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return reportPlan(plan, "plan_", planSummary(plan))
+	}
+	return err // nil
 }
 
-func listWorker(id int, job map[string]interface{}, wg *sync.WaitGroup) {
-	log.Println("list worker", id, "starting job of ", len(job), " keys")
-	for k, v := range job {
-		// Assert v == nil; lazy read to help parallelization
-		log.Printf("list worker %d reading %s\n", id, k)
-		var err error
-		v, err = readRaw(srcClients[id], k)
+func syncWorker(ctx context.Context, id int, jobs <-chan job, base *syncBase, plan *Plan, mu *sync.Mutex, wg *sync.WaitGroup) {
+	logDetail("sync worker %d starting\n", id)
+	count := 0
+	for j := range jobs {
+		if stopErr(ctx) != nil {
+			report.count("not_started", 1)
+			continue
+		}
+		count++
+		action, err := syncKey(ctx, id, j.path, base, plan, mu)
 		if err != nil {
-			log.Printf("Error from readRaw: %s\n", err)
+			recordFailure("sync", j.path, err)
+			continue
+		}
+		if plan != nil {
+			continue // the plan is printed at the end
 		}
+		report.count(strings.Replace(action, " ", "_", -1), 1)
+		if action == "in sync" {
+			logDetail("sync worker %d key %s %s\n", id, j.path, action)
+			continue
+		}
+		report.count(strings.Fields(action)[0], 1) // created, updated or deleted in either Vault
+		log.Printf("sync worker %d key %s %s\n", id, j.path, action)
+	}
+	logDetail("sync worker %d finished sync job of %d keys\n", id, count)
+	wg.Done()
+}
 
-		// print just the data element as we expect the metadata to be different, which would make determining diffs hard
-		vComplete := v.(map[string]interface{})
-		if kvApi {
-			vData := vComplete["data"]
-			v2, err := marshalData(vData.(map[string]interface{}))
-			if err != nil {
-				log.Printf("Error from marshalData: %s\n", err)
-			}
-			line := fmt.Sprintf("%s %s\n", k, v2)
-			_, err = listFile.WriteString(line)
-			if err != nil {
-				log.Printf("Error from listFile.WriteString(%s): %s\n", line, err)
+// syncSide is one Vault of a two way sync
+type syncSide struct {
+	name   string // source or destination
+	client *api.Client
+	path   string
+	mount  string
+	v2     bool
+	data   map[string]interface{}
+	hash   string // "" when the path is missing
+}
+
+// rootRelPath returns the path of a listed secret below the logical kv root (secret/data/app/a below secret/app -> a)
+func rootRelPath(path, root, mount string, v2 bool) string {
+	return strings.TrimPrefix(logicalPath(path, mount, v2), strings.TrimSuffix(root, "/")+"/")
+}
+
+// syncPath returns the api path of the secret rel below the logical kv root (a below secret/app -> secret/data/app/a)
+func syncPath(root, rel, mount string, v2 bool) string {
+	return apiPath(strings.TrimSuffix(root, "/")+"/"+rel, mount, v2)
+}
+
+// syncKey brings one path (below the kv roots) in sync and returns what was done, like "created in destination"
+func syncKey(ctx context.Context, id int, rel string, base *syncBase, plan *Plan, mu *sync.Mutex) (action string, err error) {
+	src := &syncSide{name: "source", client: srcClients[id], mount: kvMountPath, v2: kvApi,
+		path: syncPath(kvRoot, rel, kvMountPath, kvApi)}
+	dst := &syncSide{name: "destination", client: dstClients[id], mount: dstMountPath, v2: dstKvApi,
+		path: syncPath(dstKvRoot, rel, dstMountPath, dstKvApi)}
+	for _, side := range []*syncSide{src, dst} {
+		err = side.read(ctx)
+		if err != nil {
+			return action, err
+		}
+	}
+
+	if src.hash == dst.hash {
+		base.set(rel, src.hash)
+		return "in sync", err
+	}
+
+	bHash, known := base.get(rel)
+	var from, to *syncSide
+	switch {
+	case known && src.hash == bHash, !known && src.hash == "":
+		from, to = dst, src
+	case known && dst.hash == bHash, !known && dst.hash == "":
+		from, to = src, dst
+	default:
+		from, to, err = resolveConflict(ctx, id, src, dst)
+		if err != nil {
+			return action, err
+		}
+		if from == nil {
+			if plan != nil {
+				mu.Lock()
+				plan.add(src.path, "", changeConflict)
+				plan.Entries[len(plan.Entries)-1].Side = "both"
+				mu.Unlock()
+				return "conflict", err
 			}
-		} else {
-			v2, err := marshalData(vComplete)
+			err = fmt.Errorf("Conflict: %s changed in both Vaults since the last sync (see conflictPolicy)", rel)
+			return action, err
+		}
+	}
+
+	change := changeUpdate
+	switch {
+	case from.hash == "":
+		change = changeDelete
+	case to.hash == "":
+		change = changeCreate
+	}
+	action = fmt.Sprintf("%sd in %s", change, to.name)
+	if plan != nil {
+		mu.Lock()
+		plan.add(to.path, "", change)
+		plan.Entries[len(plan.Entries)-1].Side = to.name
+		mu.Unlock()
+		return action, err
+	}
+
+	if change == changeDelete {
+		path := to.path
+		if to.v2 {
+			path = kvV2Path(to.path, to.mount, "metadata")
+		}
+		_, err = vaultDelete(ctx, to.client, path)
+	} else {
+		payload := from.data
+		if to.v2 {
+			payload = map[string]interface{}{"data": from.data}
+			err = addCas(ctx, to.client, to.path, to.mount, payload)
+		}
+		if err == nil {
+			_, err = vaultWrite(ctx, to.client, to.path, payload)
+		}
+	}
+	if err != nil {
+		return action, fmt.Errorf("Error from Vault %s of key %s: %s", change, to.path, err)
+	}
+	base.set(rel, from.hash)
+	return action, err
+}
+
+// read reads the data of the side's path and its hash; a missing secret (or a deleted kv v2 version) has no hash
+func (side *syncSide) read(ctx context.Context) (err error) {
+	raw, found, err := readIfFound(ctx, side.client, side.path)
+	if err != nil {
+		return fmt.Errorf("Error reading %s from the %s Vault: %s", side.path, side.name, err)
+	}
+	if !found {
+		return err // nil
+	}
+	side.data = secretData(raw, side.v2)
+	if side.data == nil {
+		return err // nil
+	}
+	side.hash, err = dataHash(side.data)
+	return err
+}
+
+// resolveConflict applies conflictPolicy to a path changed in both Vaults; from is nil when it stays a conflict
+func resolveConflict(ctx context.Context, id int, src, dst *syncSide) (from, to *syncSide, err error) {
+	switch *conflictPolicy {
+	case policySource:
+		return src, dst, err
+	case policyNewest:
+		if !src.v2 || !dst.v2 || src.hash == "" || dst.hash == "" {
+			return from, to, err // without kv v2 update times on both sides there is no newest side
+		}
+		var times [2]time.Time
+		for i, side := range []*syncSide{src, dst} {
+			sv, err := readSecretVersion(ctx, side.client, side.path, side.mount)
 			if err != nil {
-				log.Printf("Error from marshalData: %s\n", err)
+				return from, to, err
 			}
-			line := fmt.Sprintf("%s %s\n", k, v2)
-			_, err = listFile.WriteString(line)
+			times[i], err = time.Parse(time.RFC3339Nano, sv.UpdatedTime)
 			if err != nil {
-				log.Printf("Error from listFile.WriteString(%s): %s\n", line, err)
+				return from, to, fmt.Errorf("Illegal updated_time of %s: %s", side.path, err)
 			}
 		}
+		if times[1].After(times[0]) {
+			return dst, src, err
+		}
+		return src, dst, err
 	}
-	log.Println("list worker", id, "finished job of", len(job), " keys")
-	wg.Done()
+	return from, to, err
 }
 
-func writeWorker(id int, job map[string]interface{}, wg *sync.WaitGroup) {
-	fmt.Println("write worker", id, "starting write job of ", len(job), " keys")
-	var err error
-	for k, v := range job {
-		if v == nil || v == "" {
-			log.Printf("write worker %d reading %s\n", id, k)
-			v, err = readRaw(srcClients[id], k)
-			if err != nil {
-				log.Printf("Error from readRaw: %s\n", err)
-			}
-		}
-		log.Printf("!!! write worker %d writing key %s\n", id, k)
-		_, err = dstClients[id].Logical().Write(k, v.(map[string]interface{}))
+// dataHash is the hex sha256 of the canonical (sorted key) json encoding of secret data
+func dataHash(data map[string]interface{}) (hash string, err error) {
+	v, err := marshalData(data)
+	if err != nil {
+		return hash, err
+	}
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:]), err
+}
+
+// Outcomes of doVerify for each path
+const (
+	verifyMatch    = "match"
+	verifyMissing  = "missing"  // in the source but not in the destination Vault
+	verifyExtra    = "extra"    // in the destination Vault but not in the source
+	verifyMismatch = "mismatch" // in both with different data
+)
+
+/*
+ * verify compares every selected source entry (from the source Vault or srcInputFile) with its dst entry (from the
+ * dst Vault or dstInputFile) by the hash of their data, then lists the dst entries no source entry maps to
+ * The paths that differ are printed (never values; with doDiff also their added, removed and changed keys with
+ * redacted values) and errDifferent is returned when there are any
+ */
+func verify(ctx context.Context, path, dstPath string) (err error) {
+	report.addMount(kvRoot, kvApi, dstKvRoot, dstKvApi)
+	defer report.phase("verify", kvRoot)()
+
+	result := &Plan{Counts: map[string]int{}}
+
+	dstFileKV = nil
+	if *dstInputFile != "" {
+		dstFileKV = map[string]map[string]interface{}{}
+		err = readListingFile(*dstInputFile, dstMountPath, dstKvApi, func(j job) error {
+			dstFileKV[j.path] = j.value
+			return nil
+		})
 		if err != nil {
-			log.Printf("Error from Vault write: %s\n", err)
+			return fmt.Errorf("Error reading dstInputFile %s: %s", *dstInputFile, err)
 		}
 	}
-	fmt.Println("write worker", id, "finished write job of", len(job), " keys")
-	wg.Done()
-}
 
-func listFromFile(kv map[string]interface{}) (err error) {
+	// wantKV holds the dst path of every source entry
+	wantKV := map[string]bool{}
+
+	jobs := make(chan job, *numWorkers)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for w := 0; w < *numWorkers; w++ {
+		wg.Add(1)
+		go verifyWorker(ctx, w, jobs, result, &mu, &wg)
+	}
+
+	count := 0
+	err = walkSource(ctx, path, func(j job) error {
+		if err := stopErr(ctx); err != nil {
+			return err
+		}
+		count++
+		wantKV[rewritePath(j.path)] = true
+		jobs <- j
+		return nil
+	})
+	close(jobs)
+
+	wg.Wait()
 
-	f, err := os.Open(*srcInputFile)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	report.count("listed", count)
 
-	reader := bufio.NewReader(f)
-
-	for {
-		str, err := reader.ReadString('\n')
-		if err == io.EOF {
-			break
+	var extra []string
+	dstCount := 0
+	if dstFileKV != nil {
+		for k := range dstFileKV {
+			dstCount++
+			if !wantKV[k] {
+				extra = append(extra, k)
+			}
 		}
-		parts := strings.Split(str, " ")
-		k := strings.TrimSuffix(parts[0], "\n")
-		v := strings.TrimSuffix(parts[1], "\n")
-		// TODO consider which version of kv api (currently supporting only v2)
-		if kvApi {
-			v = fmt.Sprintf("{\"data\":%s}", v)
-		} else {
+	} else {
+		err = list(ctx, dstClients, dstPath, dstMountPath, dstKvApi, false, func(k string) error {
+			dstCount++
+			if !wantKV[k] {
+				extra = append(extra, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, k := range extra {
+		var keys []KeyDiff
+		if *doDiff {
+			dv, err := readDst(ctx, 0, k)
+			if err != nil {
+				recordFailure("verify", k, err)
+				continue
+			}
+			keys = keyDiff(nil, secretData(dv, dstKvApi))
+		}
+		result.add(k, "", verifyExtra)
+		result.Entries[len(result.Entries)-1].Keys = keys
+	}
+	logDetail("Info: The source has %d keys and the destination has %d keys\n", count, dstCount)
+
+	err = reportPlan(result, "", verifySummary(result))
+	if err != nil {
+		return err
+	}
+	if len(result.Entries) > 0 {
+		return errDifferent
+	}
+	return err // nil
+}
+
+func verifyWorker(ctx context.Context, id int, jobs <-chan job, result *Plan, mu *sync.Mutex, wg *sync.WaitGroup) {
+	logDetail("verify worker %d starting\n", id)
+	count := 0
+	for j := range jobs {
+		if stopErr(ctx) != nil {
+			report.count("not_started", 1)
+			continue
+		}
+		count++
+		dk := rewritePath(j.path)
+		outcome, keys, err := verifyKey(ctx, id, j, dk)
+		if err != nil {
+			recordFailure("verify", j.path, err)
+			continue
+		}
+		mu.Lock()
+		if outcome == verifyMatch {
+			result.Counts[outcome]++
+		} else {
+			result.add(dk, j.path, outcome)
+			result.Entries[len(result.Entries)-1].Keys = keys
+		}
+		mu.Unlock()
+	}
+	logDetail("verify worker %d finished verify job of %d keys\n", id, count)
+	wg.Done()
+}
+
+// verifyKey compares the hash of the data of a source entry with the hash of the data of its dst entry
+// (and with doDiff returns their key differences)
+// A missing secret, or a kv v2 secret whose latest version is deleted, has no data
+func verifyKey(ctx context.Context, id int, j job, dk string) (outcome string, keys []KeyDiff, err error) {
+	v := j.value
+	if v == nil {
+		v, _, err = readIfFound(ctx, srcClients[id], j.path)
+		if err != nil {
+			return outcome, keys, fmt.Errorf("Error reading %s from the source Vault: %s", j.path, err)
+		}
+	}
+	dv, err := readDst(ctx, id, dk)
+	if err != nil {
+		return outcome, keys, err
+	}
+
+	data := [2]map[string]interface{}{secretData(v, kvApi), secretData(dv, dstKvApi)}
+	var hashes [2]string
+	for i := range data {
+		if data[i] == nil {
+			continue
+		}
+		hashes[i], err = dataHash(data[i])
+		if err != nil {
+			return outcome, keys, fmt.Errorf("Error hashing key %s: %s", j.path, err)
+		}
+	}
+
+	switch {
+	case hashes[0] == hashes[1]:
+		return verifyMatch, keys, err
+	case hashes[1] == "":
+		outcome = verifyMissing
+	default:
+		outcome = verifyMismatch
+	}
+	if *doDiff {
+		keys = keyDiff(data[0], data[1])
+	}
+	return outcome, keys, err
+}
+
+// readDst reads a raw dst entry from dstInputFile or from the dst Vault; a missing entry is nil
+func readDst(ctx context.Context, id int, dk string) (dv map[string]interface{}, err error) {
+	if dstFileKV != nil {
+		return dstFileKV[dk], err
+	}
+	dv, _, err = readIfFound(ctx, dstClients[id], dk)
+	if err != nil {
+		err = fmt.Errorf("Error reading %s from the destination Vault: %s", dk, err)
+	}
+	return dv, err
+}
+
+// KeyDiff is the change of one key of a secret from the source to the destination
+// From and To are the source and dst values redacted as diffValues says
+type KeyDiff struct {
+	Key    string `json:"key"`
+	Change string `json:"change"` // added, removed or changed
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+// keyDiff returns the keys added, removed or changed from the source data a to the dst data b, sorted by key
+func keyDiff(a, b map[string]interface{}) (keys []KeyDiff) {
+	names := map[string]bool{}
+	for k := range a {
+		names[k] = true
+	}
+	for k := range b {
+		names[k] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for k := range names {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		av, inA := a[k]
+		bv, inB := b[k]
+		switch {
+		case !inB:
+			keys = append(keys, KeyDiff{Key: k, Change: "removed", From: redact(av)})
+		case !inA:
+			keys = append(keys, KeyDiff{Key: k, Change: "added", To: redact(bv)})
+		default:
+			from, to := valueString(av), valueString(bv)
+			if from != to {
+				keys = append(keys, KeyDiff{Key: k, Change: "changed", From: redact(av), To: redact(bv)})
+			}
+		}
+	}
+	return keys
+}
+
+// valueString is a secret value as a string: strings as they are, other json values in their json encoding
+func valueString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	ba, _ := json.Marshal(v)
+	return string(ba)
+}
+
+// redact shows a secret value as diffValues says: a salted sha256 prefix (hash), its first characters (mask)
+// or the value itself (clear)
+func redact(v interface{}) string {
+	s := valueString(v)
+	switch *diffValues {
+	case "clear":
+		return s
+	case "mask":
+		r := []rune(s)
+		n := len(r) / 4
+		if n > 3 {
+			n = 3
+		}
+		return string(r[:n]) + "****"
+	}
+	sum := sha256.Sum256([]byte(*diffSalt + s))
+	return "sha256:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// verifySummary is the last line of the verification output
+func verifySummary(result *Plan) string {
+	return fmt.Sprintf("Verify: %d match, %d missing, %d extra, %d mismatch\n",
+		result.Counts[verifyMatch], result.Counts[verifyMissing], result.Counts[verifyExtra], result.Counts[verifyMismatch])
+}
+
+// Change kinds reported in a dry run plan
+const (
+	changeCreate    = "create"
+	changeUpdate    = "update"
+	changeDelete    = "delete"
+	changeUnchanged = "unchanged"
+	changeSkip      = "skip" // in both Vaults but doUpdate is not set so it is not compared
+	changeConflict  = "conflict"
+)
+
+// PlanEntry is a single change of a dry run plan; it never carries secret values
+// Source is only set when a rewrite rule maps the source path to a different dst path
+type PlanEntry struct {
+	Path   string    `json:"path"`
+	Source string    `json:"source,omitempty"`
+	Side   string    `json:"side,omitempty"` // only set by doSync: the Vault changed (source or destination) or both
+	Change string    `json:"change"`
+	Keys   []KeyDiff `json:"keys,omitempty"` // only set by doDiff
+}
+
+// Plan is the set of changes a copy or mirror would make to the destination Vault
+type Plan struct {
+	Entries []PlanEntry    `json:"entries"`
+	Counts  map[string]int `json:"counts"`
+}
+
+func (p *Plan) add(path, source, change string) {
+	if source == path {
+		source = ""
+	}
+	p.Entries = append(p.Entries, PlanEntry{Path: path, Source: source, Change: change})
+	p.Counts[change]++
+}
+
+// planWorker works out the change copy would make for each job without writing anything
+func planWorker(ctx context.Context, id int, jobs <-chan job, plan *Plan, mu *sync.Mutex, wg *sync.WaitGroup) {
+	log.Println("plan worker", id, "starting")
+	count := 0
+	for j := range jobs {
+		if stopErr(ctx) != nil {
+			report.count("not_started", 1)
+			continue
+		}
+		count++
+		dk := rewritePath(j.path)
+		change := changeUnchanged
+		_, moved, err := versionMoved(ctx, id, j.path)
+		if err == nil && moved {
+			change, err = planKey(ctx, id, j, dk)
+		}
+		if err != nil {
+			recordFailure("plan", j.path, err)
+			continue
+		}
+		mu.Lock()
+		plan.add(dk, j.path, change)
+		mu.Unlock()
+	}
+	log.Println("plan worker", id, "finished job of", count, " keys")
+	wg.Done()
+}
+
+func planKey(ctx context.Context, id int, j job, dk string) (change string, err error) {
+	dv, found, err := readIfFound(ctx, dstClients[id], dk)
+	if err != nil {
+		err = fmt.Errorf("Error from readIfFound: %s", err)
+		return change, err
+	}
+	if !found {
+		return changeCreate, err
+	}
+	if !*doUpdate {
+		return changeSkip, err
+	}
+
+	v := j.value
+	if v == nil {
+		v, err = readRaw(ctx, srcClients[id], j.path)
+		if err != nil {
+			err = fmt.Errorf("Error from readRaw: %s", err)
+			return change, err
+		}
+	}
+	same, err := sameData(v, dv)
+	if err != nil {
+		err = fmt.Errorf("Error comparing key %s: %s", j.path, err)
+		return change, err
+	}
+	change = changeUpdate
+	if same {
+		change = changeUnchanged
+	}
+	return change, err
+}
+
+// planSummary is the last line (or two with conflicts) of a dry run plan
+func planSummary(plan *Plan) string {
+	summary := fmt.Sprintf("Plan: %d to create, %d to update, %d to delete, %d unchanged, %d skipped\n",
+		plan.Counts[changeCreate], plan.Counts[changeUpdate], plan.Counts[changeDelete],
+		plan.Counts[changeUnchanged], plan.Counts[changeSkip])
+	if plan.Counts[changeConflict] > 0 {
+		summary += fmt.Sprintf("Plan: %d conflicts (changed in both Vaults)\n", plan.Counts[changeConflict])
+	}
+	return summary
+}
+
+// reportPlan adds the counts of a dry run plan (or of a verification) to the report with the counter prefix
+// and prints its entries sorted by path
+func reportPlan(plan *Plan, prefix, summary string) (err error) {
+	for change, n := range plan.Counts {
+		report.count(prefix+change, n)
+	}
+	sort.Slice(plan.Entries, func(i, j int) bool {
+		a, b := plan.Entries[i], plan.Entries[j]
+		return a.Path < b.Path || a.Path == b.Path && a.Side < b.Side
+	})
+	return printPlan(os.Stdout, plan, summary)
+}
+
+// printPlan writes the plan as text (one "change path" line per entry, followed by its key differences, and the summary)
+// or as json depending on planFormat
+func printPlan(w io.Writer, plan *Plan, summary string) (err error) {
+	if *planFormat == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+
+	for _, e := range plan.Entries {
+		switch {
+		case e.Source != "":
+			_, err = fmt.Fprintf(w, "%-9s %s (from %s)\n", e.Change, e.Path, e.Source)
+		case e.Side != "":
+			_, err = fmt.Fprintf(w, "%-9s %s %s\n", e.Change, e.Side, e.Path)
+		default:
+			_, err = fmt.Fprintf(w, "%-9s %s\n", e.Change, e.Path)
+		}
+		if err != nil {
+			return err
+		}
+		for _, k := range e.Keys {
+			switch k.Change {
+			case "added":
+				_, err = fmt.Fprintf(w, "    + %s: %s\n", k.Key, k.To)
+			case "removed":
+				_, err = fmt.Fprintf(w, "    - %s: %s\n", k.Key, k.From)
+			default:
+				_, err = fmt.Fprintf(w, "    ~ %s: %s -> %s\n", k.Key, k.From, k.To)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = io.WriteString(w, summary)
+	return err
+}
+
+func listWorker(ctx context.Context, id int, jobs <-chan job, wg *sync.WaitGroup) {
+	log.Println("list worker", id, "starting")
+	count := 0
+	for j := range jobs {
+		if stopErr(ctx) != nil {
+			report.count("not_started", 1)
+			continue
+		}
+		count++
+		err := listKey(ctx, id, j.path)
+		if err != nil {
+			recordFailure("list", j.path, err)
+		}
+	}
+	log.Println("list worker", id, "finished job of", count, " keys")
+	wg.Done()
+}
+
+// listKey reads a source secret and writes its listing file line
+func listKey(ctx context.Context, id int, k string) (err error) {
+	log.Printf("list worker %d reading %s\n", id, k)
+	v, err := readRaw(ctx, srcClients[id], k)
+	if err != nil {
+		return fmt.Errorf("Error from readRaw: %s", err)
+	}
+
+	// print just the data element as we expect the metadata to be different, which would make determining diffs hard
+	v2, err := marshalData(secretData(v, kvApi))
+	if err != nil {
+		return fmt.Errorf("Error from marshalData: %s", err)
+	}
+	line := fmt.Sprintf("%s %s\n", k, v2)
+	if kvApi && *withMetadata {
+		// the secret metadata is added as a third column
+		md, err := readMetadata(ctx, srcClients[id], k, kvMountPath)
+		if err != nil {
+			return fmt.Errorf("Error from readMetadata: %s", err)
+		}
+		v3, err := marshalData(md)
+		if err != nil {
+			return fmt.Errorf("Error from marshalData: %s", err)
+		}
+		line = fmt.Sprintf("%s %s %s\n", k, v2, v3)
+	}
+	_, err = listFile.WriteString(line)
+	if err != nil {
+		return fmt.Errorf("Error from listFile.WriteString(%s): %s", k, err)
+	}
+	return err // nil
+}
+
+// writeWorker writes each job (a source entry) to its rewritten path in the dst Vault
+// Entries already in the dst Vault are only rewritten with doUpdate and when their data differs
+func writeWorker(ctx context.Context, id int, jobs <-chan job, wg *sync.WaitGroup) {
+	logDetail("write worker %d starting\n", id)
+	count := 0
+	for j := range jobs {
+		if stopErr(ctx) != nil {
+			report.count("not_started", 1)
+			continue
+		}
+		count++
+		dk, action := rewritePath(j.path), "unchanged"
+		sv, moved, err := versionMoved(ctx, id, j.path)
+		if err == nil && moved {
+			dk, action, err = writeKey(ctx, id, j)
+		}
+		journalRecord("write", j.path, err)
+		if err != nil {
+			recordFailure("write", j.path, err)
+			continue
+		}
+		if incremental {
+			state.set(j.path, sv)
+		}
+		report.count(action, 1)
+		if action == "unchanged" || action == "skipped" {
+			logDetail("write worker %d key %s %s\n", id, dk, action)
+			continue
+		}
+		log.Printf("write worker %d key %s %s\n", id, dk, action)
+	}
+	logDetail("write worker %d finished write job of %d keys\n", id, count)
+	wg.Done()
+}
+
+// writeKey copies a single source entry to the dst Vault and returns its dst path and what was done to it
+// (created, updated, unchanged or skipped)
+func writeKey(ctx context.Context, id int, j job) (dk string, action string, err error) {
+	dk = rewritePath(j.path)
+	dv, found, err := readIfFound(ctx, dstClients[id], dk)
+	if err != nil {
+		err = fmt.Errorf("Error from readIfFound: %s", err)
+		return dk, action, err
+	}
+	if found && !*doUpdate {
+		action = "skipped" // it is in dest and doUpdate is not set
+		return dk, action, err
+	}
+
+	v := j.value
+	if v == nil {
+		logDetail("write worker %d reading %s\n", id, j.path)
+		v, err = readRaw(ctx, srcClients[id], j.path)
+		if err != nil {
+			err = fmt.Errorf("Error from readRaw: %s", err)
+			return dk, action, err
+		}
+	}
+
+	action = "created"
+	if found {
+		same, err := sameData(v, dv)
+		if err != nil {
+			err = fmt.Errorf("Error comparing key %s: %s", j.path, err)
+			return dk, action, err
+		}
+		action = "updated"
+		if same {
+			action = "unchanged"
+		}
+	}
+
+	switch {
+	case action == "unchanged":
+	case action == "created" && *copyVersions && kvApi && dstKvApi && *srcInputFile == "":
+		logDetail("!!! write worker %d writing all versions of key %s\n", id, dk)
+		err = copyHistory(ctx, id, j.path, dk)
+		if err != nil {
+			err = fmt.Errorf("Error copying versions of key %s: %s", j.path, err)
+			return dk, action, err
+		}
+	default:
+		logDetail("!!! write worker %d writing key %s\n", id, dk)
+		payload := writePayload(v)
+		if dstKvApi {
+			err = addCas(ctx, dstClients[id], dk, dstMountPath, payload)
+			if err != nil {
+				err = fmt.Errorf("Error reading metadata of key %s: %s", dk, err)
+				return dk, action, err
+			}
+		}
+		_, err = vaultWrite(ctx, dstClients[id], dk, payload)
+		if err != nil {
+			err = fmt.Errorf("Error from Vault write of key %s: %s", dk, err)
+			return dk, action, err
+		}
+	}
+
+	// The metadata is applied after the data so that cas_required does not reject the write above
+	if kvApi && dstKvApi && *withMetadata {
+		err = syncMetadata(ctx, id, j.path, dk, j.metadata)
+		if err != nil {
+			err = fmt.Errorf("Error copying metadata of key %s: %s", j.path, err)
+			return dk, action, err
+		}
+	}
+	return dk, action, err // nil
+}
+
+func deleteWorker(ctx context.Context, id int, jobs <-chan job, wg *sync.WaitGroup) {
+	logDetail("delete worker %d starting\n", id)
+	count := 0
+	for j := range jobs {
+		if stopErr(ctx) != nil {
+			report.count("not_started", 1)
+			continue
+		}
+		count++
+		k := j.path
+		// For the kv v2 api delete the metadata so that all versions of the secret are removed
+		path := k
+		if dstKvApi {
+			path = kvV2Path(k, dstMountPath, "metadata")
+		}
+		logDetail("!!! delete worker %d deleting key %s\n", id, path)
+		_, err := vaultDelete(ctx, dstClients[id], path)
+		journalRecord("delete", k, err)
+		if err != nil {
+			recordFailure("delete", k, fmt.Errorf("Error from Vault delete: %s", err))
+			continue
+		}
+		report.count("deleted", 1)
+		if state != nil {
+			state.deletedDst(k)
+		}
+		log.Printf("Deleted key %s from dest Vault\n", k)
+	}
+	logDetail("delete worker %d finished delete job of %d keys\n", id, count)
+	wg.Done()
+}
+
+// logDetail logs the per-key and per-worker progress, which watch mode leaves out so that it only logs the changes
+func logDetail(format string, v ...interface{}) {
+	if *watch > 0 {
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// failure is a secret that could not be listed, planned, written or deleted
+type failure struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	Err  string `json:"error"`
+}
+
+// recordFailure logs a per-secret error and keeps it for the summary printed at the end of the run
+func recordFailure(op, path string, err error) {
+	log.Printf("%s\n", err)
+	failuresMu.Lock()
+	failures = append(failures, failure{Op: op, Path: path, Err: err.Error()})
+	failuresMu.Unlock()
+}
+
+// printFailures logs the summary of the secrets that failed (sorted by path)
+func printFailures() {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+
+	if len(failures) == 0 {
+		logDetail("Info: Summary: no secret failed\n")
+		return
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Path < failures[j].Path
+	})
+	log.Printf("Error: Summary: %d secrets failed:\n", len(failures))
+	for _, f := range failures {
+		log.Printf("  %s %s: %s\n", f.Op, f.Path, strings.Replace(f.Err, "\n", " ", -1))
+	}
+}
+
+// Report is the json run report written to reportFile; it never carries secret values
+type Report struct {
+	Mode         string         `json:"mode"`
+	DryRun       bool           `json:"dryRun,omitempty"`
+	SrcAddr      string         `json:"srcAddr,omitempty"`
+	SrcInputFile string         `json:"srcInputFile,omitempty"`
+	DstAddr      string         `json:"dstAddr,omitempty"`
+	Mounts       []ReportMount  `json:"mounts"`
+	Counts       map[string]int `json:"counts"`
+	Retries      int64          `json:"retries"`
+	Phases       []ReportPhase  `json:"phases"`
+	Failures     []failure      `json:"failures"`
+	Error        string         `json:"error,omitempty"`
+	ExitCode     int            `json:"exitCode"`
+	Start        time.Time      `json:"start"`
+	End          time.Time      `json:"end"`
+
+	mu sync.Mutex
+}
+
+// ReportMount is a mount listed or copied by the run (DstPath is empty for a listing)
+type ReportMount struct {
+	Path         string `json:"path"`
+	KvVersion    int    `json:"kvVersion"`
+	DstPath      string `json:"dstPath,omitempty"`
+	DstKvVersion int    `json:"dstKvVersion,omitempty"`
+}
+
+// ReportPhase is the duration of a phase of the run (setup, list, copy or mirror)
+type ReportPhase struct {
+	Name    string  `json:"name"`
+	Mount   string  `json:"mount,omitempty"`
+	Seconds float64 `json:"seconds"`
+}
+
+func newReport() *Report {
+	return &Report{Counts: map[string]int{}, Start: time.Now()}
+}
+
+func (r *Report) count(name string, n int) {
+	r.mu.Lock()
+	r.Counts[name] += n
+	r.mu.Unlock()
+}
+
+func (r *Report) addMount(path string, v2 bool, dstPath string, dstV2 bool) {
+	m := ReportMount{Path: path, KvVersion: kvVersion(v2), DstPath: dstPath}
+	if dstPath != "" {
+		m.DstKvVersion = kvVersion(dstV2)
+	}
+	r.mu.Lock()
+	r.Mounts = append(r.Mounts, m)
+	r.mu.Unlock()
+}
+
+// phase starts timing a phase of the run; the returned func ends it
+func (r *Report) phase(name, mount string) func() {
+	start := time.Now()
+	return func() {
+		r.mu.Lock()
+		r.Phases = append(r.Phases, ReportPhase{Name: name, Mount: mount, Seconds: time.Since(start).Seconds()})
+		r.mu.Unlock()
+	}
+}
+
+// writeReport completes the run report with the outcome of the run and writes it to reportFile
+func writeReport(code int, runErr error) (err error) {
+	r := report
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case *doMerge:
+		r.Mode = "merge"
+	case *doDiff:
+		r.Mode = "diff"
+	case *doVerify:
+		r.Mode = "verify"
+	case *doSync:
+		r.Mode = "sync"
+	case *doMirror:
+		r.Mode = "mirror"
+	case *doCopy:
+		r.Mode = "copy"
+	default:
+		r.Mode = "list"
+	}
+	r.DryRun = *dryRun
+	r.SrcAddr = *srcVaultAddr
+	r.SrcInputFile = *srcInputFile
+	r.DstAddr = *dstVaultAddr
+	r.Retries = atomic.LoadInt64(&retryCount)
+	failuresMu.Lock()
+	r.Failures = append([]failure{}, failures...)
+	failuresMu.Unlock()
+	r.Counts["failed"] = len(r.Failures)
+	if runErr != nil && runErr != errSecretsFailed && runErr != errDifferent {
+		r.Error = runErr.Error()
+	}
+	r.ExitCode = code
+	r.End = time.Now()
+
+	f, err := os.Create(*reportFile)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// secretVersion is the kv v2 metadata of a source secret that tells whether it changed since the last run
+type secretVersion struct {
+	Version     int    `json:"version"`
+	UpdatedTime string `json:"updated_time"`
+}
+
+// syncState is the stateFile content: the versions of the source secrets copied by the runs so far (keyed by source path)
+type syncState struct {
+	Versions map[string]secretVersion `json:"versions"`
+
+	mu      sync.Mutex
+	loaded  bool              // stateFile existed
+	seen    map[string]bool   // the source paths listed by this run
+	pending map[string]string // dst path -> source path of the deletes of deleteDeleted
+}
+
+func (st *syncState) set(path string, sv secretVersion) {
+	st.mu.Lock()
+	st.Versions[path] = sv
+	st.mu.Unlock()
+}
+
+func (st *syncState) see(path string) {
+	st.mu.Lock()
+	st.seen[path] = true
+	st.mu.Unlock()
+}
+
+// deletedUnder returns the source paths below the logical root (secret/ or secret/app) that are in the state
+// but were not listed by this run (the paths the filters exclude are left alone)
+func (st *syncState) deletedUnder(root string) (deleted []string) {
+	root = strings.TrimSuffix(root, "/")
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for k := range st.Versions {
+		if st.seen[k] {
+			continue
+		}
+		if lp := logicalPath(k, kvMountPath, true); lp != root && !strings.HasPrefix(lp, root+"/") {
+			continue
+		}
+		if hasFilters() && !pathSelected(relPath(k, kvMountPath, true)) {
+			continue
+		}
+		deleted = append(deleted, k)
+	}
+	sort.Strings(deleted)
+	return deleted
+}
+
+func (st *syncState) forget(paths []string) {
+	st.mu.Lock()
+	for _, k := range paths {
+		delete(st.Versions, k)
+	}
+	st.mu.Unlock()
+}
+
+func (st *syncState) pendingDelete(dstPath, path string) {
+	st.mu.Lock()
+	st.pending[dstPath] = path
+	st.mu.Unlock()
+}
+
+// deletedDst forgets the source secret of a dst path once its delete succeeded (a failed delete is retried by the next run)
+func (st *syncState) deletedDst(dstPath string) {
+	st.mu.Lock()
+	if k, ok := st.pending[dstPath]; ok {
+		delete(st.Versions, k)
+		delete(st.pending, dstPath)
+	}
+	st.mu.Unlock()
+}
+
+// readSecretVersion reads the current version and update time of a kv v2 secret given its data path
+func readSecretVersion(ctx context.Context, client *api.Client, path, mount string) (sv secretVersion, err error) {
+	s, err := vaultRead(ctx, client, kvV2Path(path, mount, "metadata"))
+	if err != nil {
+		return sv, err
+	}
+	if s == nil {
+		err = fmt.Errorf("No metadata found for %s", path)
+		return sv, err
+	}
+	sv.Version, err = strconv.Atoi(fmt.Sprint(s.Data["current_version"]))
+	if err != nil {
+		err = fmt.Errorf("Illegal current_version of %s: %s", path, err)
+		return sv, err
+	}
+	sv.UpdatedTime = fmt.Sprint(s.Data["updated_time"])
+	return sv, err
+}
+
+// versionMoved reads the version of a source secret and reports whether it moved since the run that saved stateFile
+// Every secret has moved when the copy is not incremental
+func versionMoved(ctx context.Context, id int, path string) (sv secretVersion, moved bool, err error) {
+	if !incremental {
+		return sv, true, err
+	}
+	sv, err = readSecretVersion(ctx, srcClients[id], path, kvMountPath)
+	if err != nil {
+		return sv, moved, fmt.Errorf("Error reading the version of %s: %s", path, err)
+	}
+	state.mu.Lock()
+	old, ok := state.Versions[path]
+	state.mu.Unlock()
+	moved = !ok || old != sv
+	return sv, moved, err
+}
+
+// loadState reads stateFile (a missing file is an empty state)
+func loadState() (err error) {
+	state = &syncState{Versions: map[string]secretVersion{}, seen: map[string]bool{}, pending: map[string]string{}}
+	ba, err := ioutil.ReadFile(*stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(ba, state)
+	if err != nil {
+		return err
+	}
+	if state.Versions == nil {
+		state.Versions = map[string]secretVersion{}
+	}
+	state.loaded = true
+	return err // nil
+}
+
+// saveState writes stateFile
+func saveState() (err error) {
+	state.mu.Lock()
+	ba, err := json.Marshal(state)
+	state.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(*stateFile, ba)
+}
+
+// writeFileAtomic writes a file through a temporary file so an interrupted write leaves the previous content
+func writeFileAtomic(name string, ba []byte) (err error) {
+	tmp := name + ".tmp"
+	err = ioutil.WriteFile(tmp, ba, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// openJournal opens journalFile for appending, first loading the entries completed by earlier runs when resuming
+// Each journal line is "done <write|delete> <path>" or "fail <write|delete> <path> <error>"
+// (write entries hold the source path and delete entries the destination path)
+func openJournal() (err error) {
+	journalDone = map[string]bool{}
+
+	mode := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	partial := false // the last line was cut short (like by a crash while writing it)
+	if *resume {
+		mode = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+
+		f, err := os.Open(*journalFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			defer f.Close()
+			reader := bufio.NewReader(f)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil && err != io.EOF {
+					return err
+				}
+				if line == "" {
+					break // EOF
+				}
+				if !strings.HasSuffix(line, "\n") {
+					partial = true // its path may be cut short too so it is left out
+					break
+				}
+				fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 4)
+				if len(fields) < 3 {
+					continue
+				}
+				// the last entry of a path wins so a failed retry is retried again
+				journalDone[fields[1]+" "+fields[2]] = fields[0] == "done"
+			}
+		}
+	}
+
+	journal, err = os.OpenFile(*journalFile, mode, 0600)
+	if err == nil && partial {
+		_, err = journal.WriteString("\n")
+	}
+	return err
+}
+
+func closeJournal() {
+	journal.Close()
+	journal = nil
+}
+
+// journalRecord appends the outcome of a write or delete to the journal (if enabled)
+func journalRecord(kind, path string, err error) {
+	if journal == nil {
+		return
+	}
+	line := fmt.Sprintf("done %s %s\n", kind, path)
+	if err != nil {
+		line = fmt.Sprintf("fail %s %s %s\n", kind, path, strings.Replace(err.Error(), "\n", " ", -1))
+	}
+	_, werr := journal.WriteString(line)
+	if werr != nil {
+		log.Printf("Error from journal.WriteString(%s): %s\n", line, werr)
+	}
+}
+
+// The kv v2 secret metadata settings copied between Vaults
+var metadataFields = []string{"custom_metadata", "max_versions", "cas_required", "delete_version_after"}
+
+// readMetadata reads the copyable metadata settings of a kv v2 secret given its data path
+func readMetadata(ctx context.Context, client *api.Client, path, mount string) (md map[string]interface{}, err error) {
+	s, err := vaultRead(ctx, client, kvV2Path(path, mount, "metadata"))
+	if err != nil {
+		return md, err
+	}
+	if s == nil {
+		err = fmt.Errorf("No metadata found for %s", path)
+		return md, err
+	}
+
+	md = map[string]interface{}{}
+	for _, f := range metadataFields {
+		if fv, ok := s.Data[f]; ok && fv != nil {
+			md[f] = fv
+		}
+	}
+	return md, err
+}
+
+// syncMetadata writes the source metadata settings of a kv v2 secret to the dst Vault when they differ
+// With srcInputFile the settings are the fileMd read from the listing file
+func syncMetadata(ctx context.Context, id int, path, dstPath string, fileMd map[string]interface{}) (err error) {
+	md := fileMd
+	if *srcInputFile != "" {
+		if md == nil {
+			return err // the listing file did not carry metadata for this key
+		}
+	} else {
+		md, err = readMetadata(ctx, srcClients[id], path, kvMountPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	dmd, err := readMetadata(ctx, dstClients[id], dstPath, dstMountPath)
+	if err != nil {
+		return err
+	}
+
+	mv, err := marshalData(md)
+	if err != nil {
+		return err
+	}
+	dmv, err := marshalData(dmd)
+	if err != nil {
+		return err
+	}
+	if mv == dmv {
+		return err // nil
+	}
+
+	_, err = vaultWrite(ctx, dstClients[id], kvV2Path(dstPath, dstMountPath, "metadata"), md)
+	if err != nil {
+		return err
+	}
+	log.Printf("Copied metadata of key %s to dest Vault\n", dstPath)
+	return err // nil
+}
+
+// addCas adds the check-and-set option of a kv v2 write to payload when the metadata of path has cas_required
+// (like after withMetadata copied it), as Vault then rejects a write without the current version
+func addCas(ctx context.Context, client *api.Client, path, mount string, payload map[string]interface{}) (err error) {
+	s, err := vaultRead(ctx, client, kvV2Path(path, mount, "metadata"))
+	if err != nil || s == nil {
+		return err
+	}
+	if required, _ := s.Data["cas_required"].(bool); required {
+		payload["options"] = map[string]interface{}{"cas": s.Data["current_version"]}
+	}
+	return err // nil
+}
+
+// kvV2Path converts a kv v2 data or metadata path (like secret/data/a/b) to the path of another endpoint
+// (like secret/metadata/a/b)
+func kvV2Path(path, mount, endpoint string) string {
+	mount = pathMount(path, mount)
+	rest := strings.TrimPrefix(path, mount+"/")
+	parts := strings.SplitN(rest, "/", 2)
+	if parts[0] != "data" && parts[0] != "metadata" {
+		return path
+	}
+	parts[0] = endpoint
+	return mount + "/" + strings.Join(parts, "/")
+}
+
+// copyHistory replays every version of a kv v2 secret, oldest first, from the src Vault into the dst Vault
+// Deleted and destroyed source versions are written as empty placeholders and then deleted or destroyed
+// on the dst Vault (their data can not be read without modifying the source)
+func copyHistory(ctx context.Context, id int, path, dstPath string) (err error) {
+	s, err := vaultRead(ctx, srcClients[id], kvV2Path(path, kvMountPath, "metadata"))
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		err = fmt.Errorf("No metadata found for %s", path)
+		return err
+	}
+
+	versions, _ := s.Data["versions"].(map[string]interface{})
+	nums := make([]int, 0, len(versions))
+	for ver := range versions {
+		n, err := strconv.Atoi(ver)
+		if err != nil {
+			return fmt.Errorf("Illegal version %s of %s: %s", ver, path, err)
+		}
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+
+	for _, n := range nums {
+		info, _ := versions[strconv.Itoa(n)].(map[string]interface{})
+		destroyed, _ := info["destroyed"].(bool)
+		deleted := isDeleted(info)
+
+		data := map[string]interface{}{}
+		if !destroyed && !deleted {
+			vs, err := vaultReadWithData(ctx, srcClients[id], path, map[string][]string{"version": {strconv.Itoa(n)}})
+			if err != nil {
+				return err
+			}
+			if vs == nil {
+				return fmt.Errorf("No secret found at %s version %d", path, n)
+			}
+			data, _ = vs.Data["data"].(map[string]interface{})
+		}
+
+		dstVer, err := writeVersion(ctx, dstClients[id], dstPath, data)
+		if err != nil {
+			return err
+		}
+		log.Printf("Copied version %d of key %s to dest Vault version %d\n", n, dstPath, dstVer)
+
+		if destroyed {
+			_, err = vaultWrite(ctx, dstClients[id], kvV2Path(dstPath, dstMountPath, "destroy"), map[string]interface{}{"versions": []interface{}{dstVer}})
+		} else if deleted {
+			_, err = vaultWrite(ctx, dstClients[id], kvV2Path(dstPath, dstMountPath, "delete"), map[string]interface{}{"versions": []interface{}{dstVer}})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return err // nil
+}
+
+// writeVersion writes data as a new kv v2 version of path and returns its version number
+// Every attempt first reads current_version: when an earlier attempt (like one that timed out) was applied after all
+// its version is returned instead of writing an extra one, and the write uses check-and-set on the version read
+func writeVersion(ctx context.Context, client *api.Client, path string, data map[string]interface{}) (ver int, err error) {
+	prev := -1
+	err = withRetry(ctx, "write "+path, func() (err error) {
+		s, err := vaultRequest(ctx, client, "GET", kvV2Path(path, dstMountPath, "metadata"), nil, nil)
+		if err != nil {
+			return err
+		}
+		cur := 0
+		if s != nil {
+			cur, err = strconv.Atoi(fmt.Sprint(s.Data["current_version"]))
+			if err != nil {
+				return fmt.Errorf("Illegal current_version of %s: %s", path, err)
+			}
+		}
+		if prev >= 0 && cur > prev {
+			ver = cur  // the previous attempt was applied
+			return err // nil
+		}
+		prev = cur
+
+		ws, err := vaultRequest(ctx, client, "PUT", path, nil, map[string]interface{}{
+			"data":    data,
+			"options": map[string]interface{}{"cas": cur},
+		})
+		if err != nil {
+			return err
+		}
+		if ws == nil {
+			return fmt.Errorf("No version returned writing %s", path)
+		}
+		ver, err = strconv.Atoi(fmt.Sprint(ws.Data["version"]))
+		if err != nil {
+			return fmt.Errorf("Illegal version returned writing %s: %s", path, err)
+		}
+		return err // nil
+	})
+	return ver, err
+}
+
+// isDeleted reports whether the kv v2 version metadata has a deletion_time that has passed
+func isDeleted(info map[string]interface{}) bool {
+	dt, _ := info["deletion_time"].(string)
+	if dt == "" {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339Nano, dt)
+	if err != nil {
+		return true
+	}
+	return !t.After(time.Now())
+}
+
+// pathMount returns mount when path is in it, else the first path segment (a path outside the known mount,
+// like a rewritten path, is taken to be in a one segment mount)
+func pathMount(path, mount string) string {
+	if mount != "" && (path == mount || strings.HasPrefix(path, mount+"/")) {
+		return mount
+	}
+	return strings.SplitN(path, "/", 2)[0]
+}
+
+// logicalPath strips the kv v2 data segment after the mount (secret/data/a/b -> secret/a/b) so rewrite rules see
+// the same path as the vault kv cli
+func logicalPath(path, mount string, v2 bool) string {
+	if !v2 {
+		return path
+	}
+	mount = pathMount(path, mount)
+	rest := strings.TrimPrefix(path, mount+"/")
+	if strings.HasPrefix(rest, "data/") {
+		return mount + "/" + strings.TrimPrefix(rest, "data/")
+	}
+	return path
+}
+
+// apiPath re-inserts the kv v2 data segment after the mount (secret/a/b -> secret/data/a/b)
+func apiPath(path, mount string, v2 bool) string {
+	if !v2 {
+		return path
+	}
+	mount = pathMount(path, mount)
+	if !strings.HasPrefix(path, mount+"/") {
+		return path
+	}
+	return mount + "/data/" + strings.TrimPrefix(path, mount+"/")
+}
+
+func hasRewriteRules() bool {
+	return len(rewriteMap) > 0 || len(rewritePrefixes) > 0 || len(rewriteRegexes) > 0
+}
+
+// rewritePath maps a source path to its dst path, translating it between the kv v1 and v2 apis if needed
+// The first matching rule wins: an exact rewriteMapFile entry, then the rewritePrefix rules, then the rewriteRegex rules
+func rewritePath(path string) string {
+	lp := logicalPath(path, kvMountPath, kvApi)
+	if np, ok := rewriteMap[lp]; ok {
+		return apiPath(np, dstMountPath, dstKvApi)
+	}
+	for _, r := range rewritePrefixes {
+		if lp == r.from || strings.HasPrefix(lp, r.from+"/") {
+			return apiPath(r.to+strings.TrimPrefix(lp, r.from), dstMountPath, dstKvApi)
+		}
+	}
+	for _, r := range rewriteRegexes {
+		if r.re.MatchString(lp) {
+			return apiPath(r.re.ReplaceAllString(lp, r.to), dstMountPath, dstKvApi)
+		}
+	}
+	return apiPath(lp, dstMountPath, dstKvApi)
+}
+
+// checkRewrites fails when several source paths map to the same dst path
+func checkRewrites(paths []string) (err error) {
+	sources := map[string][]string{}
+	for _, k := range paths {
+		dk := rewritePath(k)
+		sources[dk] = append(sources[dk], k)
+		if dk != k {
+			logDetail("Rewriting key %s to %s\n", k, dk)
+		}
+	}
+
+	var collisions []string
+	for dk, srcs := range sources {
+		if len(srcs) > 1 {
+			sort.Strings(srcs)
+			collisions = append(collisions, fmt.Sprintf("%s <- %s", dk, strings.Join(srcs, ", ")))
+		}
+	}
+	if len(collisions) > 0 {
+		sort.Strings(collisions)
+		err = fmt.Errorf("Path rewrite collisions (several source paths map to one destination path):\n%s", strings.Join(collisions, "\n"))
+		return err
+	}
+	return err // nil
+}
+
+// loadRewriteRules parses the rewritePrefix, rewriteRegex and rewriteMapFile flags
+func loadRewriteRules() (err error) {
+	rewritePrefixes = nil
+	rewriteRegexes = nil
+	rewriteMap = map[string]string{}
+
+	for _, v := range rewritePrefix {
+		i := strings.LastIndex(v, "=")
+		if i < 1 {
+			return fmt.Errorf("Error: Illegal rewritePrefix %s; it must be like old/prefix=new/prefix", v)
+		}
+		rewritePrefixes = append(rewritePrefixes, rewriteRule{
+			from: strings.TrimSuffix(v[:i], "/"),
+			to:   strings.TrimSuffix(v[i+1:], "/"),
+		})
+	}
+
+	for _, v := range rewriteRegex {
+		i := strings.LastIndex(v, "=")
+		if i < 1 {
+			return fmt.Errorf("Error: Illegal rewriteRegex %s; it must be like regex=replacement", v)
+		}
+		re, err := regexp.Compile("^(?:" + v[:i] + ")$") // the regex must match the whole path
+		if err != nil {
+			return fmt.Errorf("Error: Illegal rewriteRegex %s: %s", v, err)
+		}
+		rewriteRegexes = append(rewriteRegexes, rewriteRule{from: v[:i], re: re, to: v[i+1:]})
+	}
+
+	if *rewriteMapFile == "" {
+		return err // nil
+	}
+
+	f, err := os.Open(*rewriteMapFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("Error: Illegal line in rewriteMapFile %s: %s", *rewriteMapFile, line)
+		}
+		rewriteMap[fields[0]] = fields[1]
+	}
+	return scanner.Err()
+}
+
+// listFromFile calls found for each selected srcInputFile entry, in file order
+func listFromFile(found func(j job) error) (err error) {
+	return readListingFile(*srcInputFile, kvMountPath, kvApi, found)
+}
+
+// readListingFile calls found for each selected entry of a listing file whose paths use the kv v2 api when v2 is set
+// The entries are in mount unless the file has mount lines
+func readListingFile(name, mount string, v2 bool, found func(j job) error) (err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	lineMount := ""
+
+	for {
+		str, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if str == "" {
+			break // EOF
+		}
+		// Each line is: path {data} [{metadata}]
+		// or (with allMounts) a mount line recording the mount of the entries that follow
+		str = strings.TrimSuffix(str, "\n")
+		if strings.HasPrefix(str, mountLinePrefix) {
+			m, err := parseMountLine(name, str)
+			if err != nil {
+				return err
+			}
+			lineMount = m.Path
+			mount = strings.TrimSuffix(m.Path, "/")
+			continue
+		}
+		if fileMount != "" && lineMount != fileMount {
+			continue
+		}
+		parts := strings.SplitN(str, " ", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		k := parts[0]
+		if hasFilters() && !pathSelected(relPath(k, mount, v2)) {
+			continue
+		}
+		dec := json.NewDecoder(strings.NewReader(parts[1]))
+		var data map[string]interface{}
+		err = dec.Decode(&data)
+		if err != nil {
+			return fmt.Errorf("Error parsing %s value in %s: %s", k, name, err)
+		}
+		j := job{path: k, value: data}
+		if dec.More() {
+			err = dec.Decode(&j.metadata)
+			if err != nil {
+				return fmt.Errorf("Error parsing %s metadata in %s: %s", k, name, err)
+			}
+		}
+		if v2 {
+			j.value = map[string]interface{}{"data": data}
+		}
+		err = found(j)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountLine formats the listing file line recording a mount
+func mountLine(m kvMount) string {
+	return fmt.Sprintf("%s%s v%d\n", mountLinePrefix, m.Path, kvVersion(m.V2))
+}
+
+func parseMountLine(name, line string) (m kvMount, err error) {
+	fields := strings.Fields(strings.TrimPrefix(line, mountLinePrefix))
+	if len(fields) != 2 || (fields[1] != "v1" && fields[1] != "v2") {
+		err = fmt.Errorf("Illegal mount line in %s: %s", name, line)
+		return m, err
+	}
+	m = kvMount{Path: fields[0], V2: fields[1] == "v2"}
+	return m, err
+}
+
+// listFileMounts returns the selected mounts recorded in srcInputFile, in file order
+func listFileMounts() (found []kvMount, err error) {
+	f, err := os.Open(*srcInputFile)
+	if err != nil {
+		return found, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return found, err
+		}
+		if line == "" {
+			break // EOF
+		}
+		if !strings.HasPrefix(line, mountLinePrefix) {
+			continue
+		}
+		m, err := parseMountLine(*srcInputFile, strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			return found, err
+		}
+		if selectedMount(m.Path) {
+			found = append(found, m)
+		}
+	}
+	return found, nil
+}
+
+// listingFile is a listing file read into memory: its entries by mount and path, and its mounts in file order
+// (a file without mount lines has a single mount "" whose kv api version is srcInputKvVersion)
+type listingFile struct {
+	mounts  []kvMount
+	entries map[string]map[string]listingEntry
+}
+
+// listingEntry is one secret line of a listing file
+type listingEntry struct {
+	line string // the line as it is in the file: path {data} [{metadata}]
+	hash string // the hash of its data
+}
+
+// loadListingFile reads the selected entries of a listing file without contacting any Vault
+func loadListingFile(name string) (lf listingFile, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return lf, err
+	}
+	defer f.Close()
+
+	lf.entries = map[string]map[string]listingEntry{}
+	mount := kvMount{V2: *srcInputKvVersion == 2}
+	seen := map[string]bool{}
+	reader := bufio.NewReader(f)
+	for {
+		str, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return lf, err
+		}
+		if str == "" {
+			break // EOF
+		}
+		str = strings.TrimSuffix(str, "\n")
+		if strings.HasPrefix(str, mountLinePrefix) {
+			mount, err = parseMountLine(name, str)
+			if err != nil {
+				return lf, err
+			}
+			continue
+		}
+		parts := strings.SplitN(str, " ", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		k := parts[0]
+		if hasFilters() && !pathSelected(relPath(k, strings.TrimSuffix(mount.Path, "/"), mount.V2)) {
+			continue
+		}
+		var data map[string]interface{}
+		err = json.NewDecoder(strings.NewReader(parts[1])).Decode(&data)
+		if err != nil {
+			return lf, fmt.Errorf("Error parsing %s value in %s: %s", k, name, err)
+		}
+		hash, err := dataHash(data)
+		if err != nil {
+			return lf, err
+		}
+		if !seen[mount.Path] {
+			seen[mount.Path] = true
+			lf.mounts = append(lf.mounts, mount)
+			lf.entries[mount.Path] = map[string]listingEntry{}
+		}
+		lf.entries[mount.Path][k] = listingEntry{line: str, hash: hash}
+	}
+	return lf, nil
+}
+
+// hasMountLines reports whether the file has entries following a mount line
+func (lf listingFile) hasMountLines() bool {
+	for _, m := range lf.mounts {
+		if m.Path != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUnmounted reports whether the file has entries not following any mount line
+func (lf listingFile) hasUnmounted() bool {
+	_, ok := lf.entries[""]
+	return ok
+}
+
+/*
+ * mergeListings writes the union of the srcInputFile and dstInputFile entries to listOutputFile, mount by mount
+ * A path in both files with different data takes the entry of the file mergePrecedence names; the entries are
+ * copied as they are (with their metadata) so the result can be used as a srcInputFile
+ */
+func mergeListings() (err error) {
+	defer report.phase("merge", "")()
+
+	src, err := loadListingFile(*srcInputFile)
+	if err != nil {
+		return fmt.Errorf("Error reading srcInputFile %s: %s", *srcInputFile, err)
+	}
+	dst, err := loadListingFile(*dstInputFile)
+	if err != nil {
+		return fmt.Errorf("Error reading dstInputFile %s: %s", *dstInputFile, err)
+	}
+
+	// the entries of a file without mount lines can not be matched with the mounts of the other file
+	if src.hasUnmounted() && dst.hasMountLines() || dst.hasUnmounted() && src.hasMountLines() {
+		return fmt.Errorf("Error: only one of %s and %s has mount lines; list both files with the same vaultcp version", *srcInputFile, *dstInputFile)
+	}
+
+	mounts := append([]kvMount{}, src.mounts...)
+	for _, m := range dst.mounts {
+		if _, ok := src.entries[m.Path]; !ok {
+			mounts = append(mounts, m)
+			continue
+		}
+		for _, sm := range src.mounts {
+			if sm.Path == m.Path && sm.V2 != m.V2 {
+				return fmt.Errorf("Error: mount %s is kv v%d in %s and kv v%d in %s", m.Path, kvVersion(sm.V2), *srcInputFile, kvVersion(m.V2), *dstInputFile)
+			}
+		}
+	}
+
+	f, err := os.Create(*listOutputFile)
+	if err != nil {
+		return fmt.Errorf("Error creating list output file %s: %s", *listOutputFile, err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	counts := map[string]int{}
+	for _, m := range mounts {
+		if m.Path != "" {
+			_, err = w.WriteString(mountLine(m))
+			if err != nil {
+				return err
+			}
+		}
+		se, de := src.entries[m.Path], dst.entries[m.Path]
+		paths := make([]string, 0, len(se)+len(de))
+		for k := range se {
+			paths = append(paths, k)
+		}
+		for k := range de {
+			if _, ok := se[k]; !ok {
+				paths = append(paths, k)
+			}
+		}
+		sort.Strings(paths)
+
+		for _, k := range paths {
+			a, inSrc := se[k]
+			b, inDst := de[k]
+			e := a
+			switch {
+			case !inDst:
+				counts["src_only"]++
+			case !inSrc:
+				e = b
+				counts["dst_only"]++
+			case a.hash == b.hash:
+				counts["same"]++
+				if *mergePrecedence == "destination" {
+					e = b
+				}
+			default:
+				counts["conflicts"]++
+				if *mergePrecedence == "destination" {
+					e = b
+				}
+				logDetail("Info: %s differs between the files; keeping the %s entry\n", k, *mergePrecedence)
+			}
+			_, err = w.WriteString(e.line + "\n")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	for name, n := range counts {
+		report.count(name, n)
+	}
+	log.Printf("Info: Merged %d paths into %s: %d only in %s, %d only in %s, %d the same, %d differing (the %s entry was kept)\n",
+		counts["src_only"]+counts["dst_only"]+counts["same"]+counts["conflicts"], *listOutputFile,
+		counts["src_only"], *srcInputFile, counts["dst_only"], *dstInputFile, counts["same"], counts["conflicts"], *mergePrecedence)
+	return err // nil
+}
+
+// listKvMounts returns the selected kv mounts of a Vault sorted by path
+// The kv api version of each mount is taken from its mount options
+func listKvMounts(ctx context.Context, client *api.Client) (found []kvMount, err error) {
+	client, err = setupClient(client)
+	if err != nil {
+		return found, err
+	}
+	var all map[string]*api.MountOutput
+	err = withRetry(ctx, "list mounts", func() (err error) {
+		all, err = client.Sys().ListMounts()
+		return err
+	})
+	if err != nil {
+		return found, err
+	}
+
+	for k, v := range all {
+		if v.Type != "kv" || !selectedMount(k) {
+			continue
+		}
+		found = append(found, kvMount{Path: k, V2: v.Options["version"] == "2"})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Path < found[j].Path
+	})
+	return found, err
+}
+
+// noMountsError explains why allMounts found no source mount to work on
+func noMountsError() error {
+	switch {
+	case *srcInputFile != "" && len(mounts) > 0:
+		return fmt.Errorf("Error: no mount line of srcInputFile %s matches mounts %s", *srcInputFile, mounts.String())
+	case *srcInputFile != "":
+		return fmt.Errorf("Error: srcInputFile %s has no mount lines (allMounts needs a listing file written with allMounts)", *srcInputFile)
+	case len(mounts) > 0:
+		return fmt.Errorf("Error: no kv mount of the source Vault matches mounts %s", mounts.String())
+	}
+	return fmt.Errorf("Error: the source Vault has no kv mount")
+}
+
+// selectedMount reports whether a mount matches one of the mounts patterns (all mounts match when there are none)
+func selectedMount(mount string) bool {
+	if len(mounts) == 0 {
+		return true
+	}
+	name := strings.TrimSuffix(mount, "/")
+	for _, pattern := range mounts {
+		ok, err := path.Match(strings.TrimSuffix(pattern, "/"), name)
+		if err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// relPath returns the secret path below the mount (secret/metadata/a/b -> a/b) that path filters are matched against
+func relPath(path, mount string, v2 bool) string {
+	mount = pathMount(path, mount)
+	if !strings.HasPrefix(path, mount+"/") {
+		return ""
+	}
+	rest := path[len(mount)+1:]
+	if v2 {
+		parts := strings.SplitN(rest, "/", 2)
+		if parts[0] == "data" || parts[0] == "metadata" {
+			if len(parts) < 2 {
+				return ""
+			}
+			rest = parts[1]
+		}
+	}
+	return rest
+}
+
+// loadFilters parses the filter flags; a pattern starting with ! excludes, any other pattern includes
+func loadFilters() (err error) {
+	includeFilters = nil
+	excludeFilters = nil
+	for _, f := range filters {
+		exclude := strings.HasPrefix(f, "!")
+		pattern := strings.Trim(strings.TrimPrefix(f, "!"), "/")
+		segs := strings.Split(pattern, "/")
+		for _, seg := range segs {
+			if _, err = path.Match(seg, ""); err != nil {
+				return fmt.Errorf("Error: Illegal filter %s: %s", f, err)
+			}
+		}
+		if exclude {
+			excludeFilters = append(excludeFilters, segs)
+		} else {
+			includeFilters = append(includeFilters, segs)
+		}
+	}
+	return err // nil
+}
+
+func hasFilters() bool {
+	return len(includeFilters) > 0 || len(excludeFilters) > 0
+}
+
+// matchSegs matches path segments against pattern segments where ** matches any number of segments
+func matchSegs(pattern, segs []string) bool {
+	if len(pattern) == 0 {
+		return len(segs) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if matchSegs(pattern[1:], segs[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segs[0])
+	return ok && matchSegs(pattern[1:], segs[1:])
+}
+
+// matchUnder reports whether the pattern could match some path below the folder segments
+func matchUnder(pattern, segs []string) bool {
+	if len(pattern) == 0 {
+		return false
+	}
+	if pattern[0] == "**" || len(segs) == 0 {
+		return true
+	}
+	ok, _ := path.Match(pattern[0], segs[0])
+	return ok && matchUnder(pattern[1:], segs[1:])
+}
+
+func matchAny(patterns [][]string, segs []string) bool {
+	for _, p := range patterns {
+		if matchSegs(p, segs) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneFolder reports whether a folder (given by its path below the mount) holds no selected secrets
+// so its subtree does not need to be listed: it matches an exclude filter, or no include filter can match below it
+func pruneFolder(rel string) bool {
+	segs := strings.Split(rel, "/")
+	if matchAny(excludeFilters, segs) {
+		return true
+	}
+	if len(includeFilters) == 0 || matchAny(includeFilters, segs) {
+		return false
+	}
+	for _, p := range includeFilters {
+		if matchUnder(p, segs) {
+			return false
+		}
+	}
+	return true
+}
+
+// pathSelected reports whether a secret (given by its path below the mount) passes the filters
+// A secret is excluded by an exclude filter matching it or one of its folders (as the folder is pruned when listing),
+// otherwise it is selected by an include filter matching it or one of its folders
+func pathSelected(rel string) bool {
+	segs := strings.Split(rel, "/")
+	for i := len(segs); i > 0; i-- {
+		if matchAny(excludeFilters, segs[:i]) {
+			return false
+		}
+	}
+	if len(includeFilters) == 0 {
+		return true
+	}
+	for i := len(segs); i > 0; i-- {
+		if matchAny(includeFilters, segs[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// folderListing is the outcome of listing one folder: the selected secret paths and the subfolders to list next
+type folderListing struct {
+	keys    []string
+	folders []string
+	err     error
+}
+
+/*
+ * list calls found with the path of each selected secret below path as it is discovered
+ * The folders are listed iteratively by listWorkers goroutines, spread over the clients, while found is only
+ * called from the calling goroutine so it needs no locking
+ */
+func list(ctx context.Context, clients []*api.Client, path, mount string, v2 bool, outputAndRead bool, found func(path string) error) (err error) {
+	n := *listWorkers
+	if n == 0 {
+		n = *numWorkers
+	}
+
+	folders := make(chan string)
+	listings := make(chan folderListing)
+	var wg sync.WaitGroup
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func(client *api.Client) {
+			defer wg.Done()
+			for folder := range folders {
+				listings <- listFolder(ctx, client, folder, mount, v2)
+			}
+		}(clients[w%len(clients)])
+	}
+
+	// pending is used as a stack so the listing goes depth first and the pending folders stay few
+	pending := []string{strings.TrimSuffix(path, "/")}
+	inFlight := 0
+	for {
+		if err == nil {
+			err = stopErr(ctx)
+		}
+		if inFlight == 0 && (len(pending) == 0 || err != nil) {
+			break
+		}
+		var next chan string
+		var folder string
+		if len(pending) > 0 && err == nil {
+			next = folders
+			folder = pending[len(pending)-1]
+		}
+
+		select {
+		case next <- folder:
+			pending = pending[:len(pending)-1]
+			inFlight++
+		case l := <-listings:
+			inFlight--
+			if err != nil {
+				continue // draining the folders in flight after an error
+			}
+			if l.err != nil {
+				err = l.err
+				continue
+			}
+			pending = append(pending, l.folders...)
+			for _, k := range l.keys {
+				err = found(k) // Intent is to lazy read
+				if err != nil {
+					break
+				}
+				if outputAndRead {
+					err = printSecret(ctx, clients[0], k)
+					if err != nil {
+						break
+					}
+				}
+			}
 		}
-		var x map[string]interface{}
-		json.Unmarshal([]byte(v), &x)
-		kv[k] = x
 	}
-	return err // nil
-}
+	close(folders)
+	wg.Wait()
 
-func list(client *api.Client, path string, outputAndRead bool, kv map[string]interface{}) (err error) {
-	path = strings.TrimSuffix(path, "/")
+	return err
+}
 
-	s, err := client.Logical().List(path)
+// listFolder lists a single folder, applying the filters to its secrets and subfolders
+func listFolder(ctx context.Context, client *api.Client, path, mount string, v2 bool) (l folderListing) {
+	s, err := vaultList(ctx, client, path)
 	if err != nil {
-		return err
+		l.err = err
+		return l
 	}
 
 	if s == nil {
-		return // no entries
+		return l // no entries
 	}
 
 	ikeys := s.Data["keys"].([]interface{})
@@ -244,34 +2680,71 @@ func list(client *api.Client, path string, outputAndRead bool, kv map[string]int
 		if strings.HasSuffix(k, "/") {
 			k2 := strings.TrimSuffix(k, "/")
 			p2 := fmt.Sprintf("%s/%s", path, k2)
-			err = list(client, p2, outputAndRead, kv)
-			if err != nil {
-				return err
+			if hasFilters() && pruneFolder(relPath(p2, mount, v2)) {
+				logDetail("Skipping folder %s (excluded by the filters)\n", p2)
+				continue
 			}
+			l.folders = append(l.folders, p2)
 		} else {
 			path2 := path
-			if kvApi {
-				path2 = strings.Replace(path, "metadata", "data", 1)
+			if v2 {
+				path2 = kvV2Path(path, mount, "data")
 			}
 			p2 := fmt.Sprintf("%s/%s", path2, k)
-			kv[p2] = nil // Intent is to lazy read
-			if outputAndRead {
-				value, err := readRaw(client, p2)
-				if err != nil {
-					return err
-				}
-				kv[p2] = value
-				v, err := marshalData(value)
-				if err != nil {
-					return err
-				}
-				fmt.Printf("%s %v\n", p2, v)
+			if hasFilters() && !pathSelected(relPath(p2, mount, v2)) {
+				continue
 			}
+			l.keys = append(l.keys, p2)
 		}
 	}
+	return l
+}
+
+func printSecret(ctx context.Context, client *api.Client, path string) (err error) {
+	value, err := readRaw(ctx, client, path)
+	if err != nil {
+		return err
+	}
+	v, err := marshalData(value)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %v\n", path, v)
 	return err
 }
 
+// secretData returns the part of a raw secret that holds the secret values (the data element for the kv v2 api)
+func secretData(raw map[string]interface{}, v2 bool) map[string]interface{} {
+	if v2 {
+		data, _ := raw["data"].(map[string]interface{})
+		return data
+	}
+	return raw
+}
+
+// writePayload converts a raw source secret into the shape the dst Vault kv api expects
+func writePayload(raw map[string]interface{}) map[string]interface{} {
+	data := secretData(raw, kvApi)
+	if dstKvApi {
+		return map[string]interface{}{"data": data}
+	}
+	return data
+}
+
+// sameData compares the secret values of a raw source secret and a raw dst secret using their canonical (sorted key) json encoding
+func sameData(a, b map[string]interface{}) (same bool, err error) {
+	av, err := marshalData(secretData(a, kvApi))
+	if err != nil {
+		return same, err
+	}
+	bv, err := marshalData(secretData(b, dstKvApi))
+	if err != nil {
+		return same, err
+	}
+	same = av == bv
+	return same, err
+}
+
 func marshalData(data map[string]interface{}) (value string, err error) {
 	ba, err := json.Marshal(data)
 	if err != nil {
@@ -281,54 +2754,367 @@ func marshalData(data map[string]interface{}) (value string, err error) {
 	return value, err
 }
 
-func read(client *api.Client, path string) (value string, err error) {
-	data, err := readRaw(client, path)
+func read(ctx context.Context, client *api.Client, path string) (value string, err error) {
+	data, err := readRaw(ctx, client, path)
 	if err != nil {
 		return value, err
 	}
 	return marshalData(data)
 }
 
-func readRaw(client *api.Client, path string) (value map[string]interface{}, err error) {
-	s, err := client.Logical().Read(path)
+func readRaw(ctx context.Context, client *api.Client, path string) (value map[string]interface{}, err error) {
+	s, err := vaultRead(ctx, client, path)
 	if err != nil {
 		return value, err
 	}
 
+	if s == nil {
+		err = fmt.Errorf("No secret found at %s", path)
+		return value, err
+	}
+
 	value = s.Data
 
 	return value, err
 }
 
-func fetchVersionInfo(client *api.Client) (kvApiLocal bool, kvRoot string, err error) {
+// readIfFound is like readRaw but reports a missing secret with found false instead of an error
+func readIfFound(ctx context.Context, client *api.Client, path string) (value map[string]interface{}, found bool, err error) {
+	s, err := vaultRead(ctx, client, path)
+	if err != nil || s == nil {
+		return value, found, err
+	}
+	return s.Data, true, err
+}
+
+// retryable reports whether a Vault request error is transient: throttling (429), a server error (500, 502, 503, 504)
+// or a network error
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *api.ResponseError:
+		switch e.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	case *url.Error, net.Error:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// backoff returns the delay before retry attempt n (1 based): retryBaseBackoff doubled for each attempt,
+// capped at retryMaxBackoff and reduced by up to retryJitter of itself at random
+func backoff(n int) time.Duration {
+	d := *retryBaseBackoff
+	for i := 1; i < n && d < *retryMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > *retryMaxBackoff {
+		d = *retryMaxBackoff
+	}
+	return d - time.Duration(rand.Float64()**retryJitter*float64(d))
+}
+
+// adaptiveLimiter limits the number of Vault requests in flight between min and max
+// using additive increase / multiplicative decrease: the limit grows by one after limit fast requests in a row
+// and halves (at most once per target latency) when a request is throttled (429 or 503) or slower than target
+type adaptiveLimiter struct {
+	mu           sync.Mutex
+	changed      chan struct{} // closed (and replaced) when a request is released so the waiting ones look again
+	limit        int
+	inUse        int
+	min          int
+	max          int
+	target       time.Duration
+	successes    int
+	lastDecrease time.Time
+}
+
+func newAdaptiveLimiter(min, max int, target time.Duration) *adaptiveLimiter {
+	return &adaptiveLimiter{changed: make(chan struct{}), limit: min, min: min, max: max, target: target}
+}
+
+// acquire waits for a free slot, or until ctx is done (like after the grace period of a stop or the timeout deadline)
+func (l *adaptiveLimiter) acquire(ctx context.Context) (err error) {
+	l.mu.Lock()
+	for l.inUse >= l.limit {
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		l.mu.Lock()
+	}
+	l.inUse++
+	l.mu.Unlock()
+	return err // nil
+}
+
+func (l *adaptiveLimiter) release(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inUse--
+
+	throttled := false
+	if respErr, ok := err.(*api.ResponseError); ok {
+		throttled = respErr.StatusCode == http.StatusTooManyRequests || respErr.StatusCode == http.StatusServiceUnavailable
+	}
+
+	if throttled || latency > l.target {
+		l.successes = 0
+		if l.limit > l.min && time.Since(l.lastDecrease) > l.target {
+			l.limit = l.limit / 2
+			if l.limit < l.min {
+				l.limit = l.min
+			}
+			l.lastDecrease = time.Now()
+			log.Printf("Info: Decreasing concurrency to %d (throttled: %t, latency: %s)\n", l.limit, throttled, latency)
+		}
+	} else if err == nil {
+		l.successes++
+		if l.successes >= l.limit && l.limit < l.max {
+			l.limit++
+			l.successes = 0
+			log.Printf("Info: Increasing concurrency to %d\n", l.limit)
+		}
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *adaptiveLimiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// withRetry calls fn until it succeeds, fails with an error that is not retryable, or retryMaxAttempts is reached
+func withRetry(ctx context.Context, what string, fn func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if concurrency != nil {
+			err = concurrency.acquire(ctx)
+			if err != nil {
+				return err
+			}
+			start := time.Now()
+			err = fn()
+			concurrency.release(time.Since(start), err)
+		} else {
+			err = fn()
+		}
+		if err == nil || ctx.Err() != nil || !retryable(err) || attempt >= *retryMaxAttempts {
+			return err
+		}
+		d := backoff(attempt)
+		atomic.AddInt64(&retryCount, 1)
+		log.Printf("Retrying %s in %s (attempt %d failed: %s)\n", what, d, attempt, err)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// The vault* functions make the Vault logical api calls with the retry policy, cancelled with ctx
+
+func vaultList(ctx context.Context, client *api.Client, path string) (s *api.Secret, err error) {
+	err = withRetry(ctx, "list "+path, func() (err error) {
+		s, err = vaultRequest(ctx, client, "LIST", path, nil, nil)
+		return err
+	})
+	return s, err
+}
+
+func vaultRead(ctx context.Context, client *api.Client, path string) (s *api.Secret, err error) {
+	err = withRetry(ctx, "read "+path, func() (err error) {
+		s, err = vaultRequest(ctx, client, "GET", path, nil, nil)
+		return err
+	})
+	return s, err
+}
+
+func vaultReadWithData(ctx context.Context, client *api.Client, path string, data map[string][]string) (s *api.Secret, err error) {
+	err = withRetry(ctx, "read "+path, func() (err error) {
+		s, err = vaultRequest(ctx, client, "GET", path, data, nil)
+		return err
+	})
+	return s, err
+}
+
+func vaultWrite(ctx context.Context, client *api.Client, path string, data map[string]interface{}) (s *api.Secret, err error) {
+	err = withRetry(ctx, "write "+path, func() (err error) {
+		s, err = vaultRequest(ctx, client, "PUT", path, nil, data)
+		return err
+	})
+	return s, err
+}
+
+func vaultDelete(ctx context.Context, client *api.Client, path string) (s *api.Secret, err error) {
+	err = withRetry(ctx, "delete "+path, func() (err error) {
+		s, err = vaultRequest(ctx, client, "DELETE", path, nil, nil)
+		return err
+	})
+	return s, err
+}
+
+// vaultRequest does what the api Logical calls do (the api has no context variants of them) but with ctx
+// As with those calls a 404 response without data or warnings is returned as a nil secret
+func vaultRequest(ctx context.Context, client *api.Client, method, path string, params url.Values, data map[string]interface{}) (s *api.Secret, err error) {
+	r := client.NewRequest(method, "/v1/"+path)
+	if method == "LIST" {
+		// like Logical().List use GET with list=true for broader compatibility
+		r.Method = "GET"
+		r.Params.Set("list", "true")
+	}
+	for k, v := range params {
+		r.Params[k] = v
+	}
+	if data != nil {
+		err = r.SetJSONBody(data)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	if l := rateLimiters[client]; l != nil {
+		err = l.Wait(ctx)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	timeout := *readTimeout
+	switch method {
+	case "LIST":
+		timeout = *listTimeout
+	case "PUT", "DELETE":
+		timeout = *writeTimeout
+	}
+	if timeout > 0 {
+		// a timed out request fails with a (retryable) *url.Error wrapping context.DeadlineExceeded
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	resp, err := client.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		secret, parseErr := api.ParseSecret(resp.Body)
+		switch {
+		case parseErr == io.EOF:
+			return nil, nil
+		case parseErr != nil:
+			return nil, err
+		}
+		if secret != nil && (len(secret.Warnings) > 0 || len(secret.Data) > 0) {
+			return secret, nil
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	return api.ParseSecret(resp.Body)
+}
+
+// fetchVersionInfo returns the kv api version, root and mount (without the trailing /) of rootFlag, or of the first
+// kv mount in sorted order when rootFlag is not set
+// The kv api version comes from the options of the mount, not from the Vault version: a kv v1 mount on a recent Vault
+// is still kv v1
+func fetchVersionInfo(client *api.Client, rootFlag string) (kvApiLocal bool, kvRoot string, mount string, err error) {
+	client, err = setupClient(client)
+	if err != nil {
+		return kvApiLocal, kvRoot, mount, err
+	}
 	sys := client.Sys()
-	if *kvRootFlag != "" {
-		kvRoot = *kvRootFlag
-	} else {
+	if rootFlag == "" {
 		mounts, err := sys.ListMounts()
 		if err != nil {
-			return kvApiLocal, kvRoot, err
+			return kvApiLocal, kvRoot, mount, err
 		}
 
-		for k, v := range mounts {
-			if v.Type == "kv" {
+		// pick the first kv mount in sorted order so the choice is the same on every run
+		names := make([]string, 0, len(mounts))
+		for k := range mounts {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			if mounts[k].Type == "kv" {
 				kvRoot = k
+				mount = strings.TrimSuffix(k, "/")
+				kvApiLocal = mounts[k].Options["version"] == "2"
 				break
 			}
 		}
+		return kvApiLocal, kvRoot, mount, err // nil
+	}
+
+	kvRoot = rootFlag
+	m, found, err := mountOf(client, rootFlag)
+	if err != nil {
+		return kvApiLocal, kvRoot, mount, err
+	}
+	if found {
+		return m.V2, kvRoot, strings.TrimSuffix(m.Path, "/"), err
 	}
 
+	// The token can read neither the mount of rootFlag nor the mount table: assume the mount is the first
+	// path segment and guess the kv api version from the Vault version (kv v2 came with 0.10)
+	mount = strings.SplitN(strings.Trim(rootFlag, "/"), "/", 2)[0]
 	healthResponse, err := sys.Health()
 	if err != nil {
-		return kvApiLocal, kvRoot, err
+		return kvApiLocal, kvRoot, mount, err
 	}
 	parts := strings.Split(healthResponse.Version, " ") // example: 0.9.5
 	parts = strings.Split(parts[0], ".")
 	majorVer, err := strconv.Atoi(parts[0])
 	minorVer, err := strconv.Atoi(parts[1])
 	kvApiLocal = majorVer > 0 || minorVer >= 10
+	log.Printf("Info: Could not read the mount of %s; assuming mount %s with the kv v%d api\n", rootFlag, mount, kvVersion(kvApiLocal))
+
+	return kvApiLocal, kvRoot, mount, err
+}
+
+// mountOf finds the kv mount holding path: from sys/internal/ui/mounts (readable by any token with access to the path)
+// or else from the mount table; found is false when the token can read neither
+func mountOf(client *api.Client, path string) (m kvMount, found bool, err error) {
+	s, rerr := client.Logical().Read("sys/internal/ui/mounts/" + strings.Trim(path, "/"))
+	if rerr == nil && s != nil {
+		if mp, ok := s.Data["path"].(string); ok && mp != "" {
+			options, _ := s.Data["options"].(map[string]interface{})
+			m = kvMount{Path: mp, V2: options != nil && fmt.Sprint(options["version"]) == "2"}
+			return m, true, err
+		}
+	}
 
-	return kvApiLocal, kvRoot, err
+	mounts, lerr := client.Sys().ListMounts()
+	if lerr != nil {
+		return m, found, err // nil: the caller falls back to the Vault version
+	}
+	p := strings.Trim(path, "/") + "/"
+	for k, v := range mounts {
+		if v.Type != "kv" || !strings.HasPrefix(p, k) || len(k) <= len(m.Path) {
+			continue
+		}
+		m = kvMount{Path: k, V2: v.Options["version"] == "2"}
+		found = true
+	}
+	if !found {
+		err = fmt.Errorf("Error: %s is not in a kv mount", path)
+	}
+	return m, found, err
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -347,6 +3133,8 @@ func setWorking(flag bool) {
 func resetForListVaultAction(srcaddr, srctoken string) {
 	*doCopy = false
 	*doMirror = false
+	*doUpdate = false
+	*dryRun = false
 	*srcInputFile = ""
 	*srcVaultAddr = srcaddr
 	*dstVaultAddr = ""
@@ -357,6 +3145,8 @@ func resetForListVaultAction(srcaddr, srctoken string) {
 func resetForFileCopyAction(outfile, dstaddr, dsttoken string) {
 	*doCopy = true
 	*doMirror = false
+	*doUpdate = false
+	*dryRun = false
 	*srcInputFile = outfile
 	*srcVaultAddr = ""
 	*srcVaultToken = ""
@@ -412,7 +3202,7 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = doAction()
+	err = doAction(r.Context())
 	if err != nil {
 		log.Printf("%s", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -586,78 +3376,314 @@ func copyFromFileHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		err = doAction()
+		err = doAction(r.Context())
+		if err != nil {
+			log.Printf("%s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	*/
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func copyFromVaultHandler(w http.ResponseWriter, r *http.Request) {
+	if working {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "busy: try again later")
+		return
+	}
+	setWorking(true)
+	defer setWorking(false)
+
+	vars := mux.Vars(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	msg := fmt.Sprintf("{\"copyFromVault\":{\"srcaddr\":\"%s\",\"dstaddr\":\"%s\"}}",
+		vars["srcaddr"], vars["dstaddr"])
+	io.WriteString(w, msg)
+}
+
+func flags() (out string, err error) {
+	kvRootFlag = flag.String("kvRootFlag", "", "Root of secret path to consider. Set to like \"secret/skydrivedev\" (or appropriate)  when using a non-admin token (can't discover from the real kv root mount point)")
+
+	dstKvRootFlag = flag.String("dstKvRootFlag", "", "Root of the destination secret path when it differs from kvRootFlag (use with rewrite rules)")
+	flag.Var(&rewritePrefix, "rewritePrefix", "Rewrite rule old/prefix=new/prefix for paths copied to the destination Vault, like secret/skydrivedev=kv/teams/skydrive (may be repeated)")
+	flag.Var(&rewriteRegex, "rewriteRegex", "Rewrite rule regex=replacement (with $1 style capture groups) for paths copied to the destination Vault; the regex must match the whole path, like secret/(.*)/dev/(.*)=kv/$1/$2 (may be repeated)")
+	rewriteMapFile = flag.String("rewriteMapFile", "", "File of \"old/path new/path\" lines mapping single source paths to destination paths")
+	allMounts = flag.Bool("allMounts", false, "List or copy every kv mount instead of the first one found (default: false)")
+	flag.Var(&filters, "filter", "Glob pattern selecting the secret paths below the mount to list, copy or mirror, like skydrivedev/** (prefix with ! to exclude, like !**/tmp/*; may be repeated). Excluded destination paths are never deleted")
+	flag.Var(&mounts, "mounts", "Mount name or glob pattern, like secret or team-*, selecting the mounts for allMounts (may be repeated; implies allMounts)")
+	listenPort = flag.Int("listenPort", 0, "Http Listen port (when > 0 act as a server)")
+	numWorkers = flag.Int("numWorkers", 10, "Number of workers to enable parallel execution")
+	listWorkers = flag.Int("listWorkers", 0, "Number of folders listed in parallel (default: numWorkers)")
+	doCopy = flag.Bool("doCopy", false, "Copy the secrets from the source to destination Vault (default: false)")
+	doMirror = flag.Bool("doMirror", false, "Like doCopy but destination Vault entries not in the source Vault will be deleted (default: false)")
+	doUpdate = flag.Bool("doUpdate", false, "With doCopy or doMirror also overwrite destination Vault entries whose data differs from the source (default: false)")
+	dryRun = flag.Bool("dryRun", false, "With doCopy or doMirror print the plan of changes to the destination Vault without writing or deleting (default: false)")
+	planFormat = flag.String("planFormat", "text", "Format of the dryRun plan and the doVerify output: \"text\" or \"json\"")
+	copyVersions = flag.Bool("copyVersions", false, "With doCopy or doMirror replay every version of new kv v2 secrets instead of only the latest one (default: false)")
+	withMetadata = flag.Bool("withMetadata", false, "Include kv v2 secret metadata (custom_metadata, max_versions, cas_required, delete_version_after) in listings and copies (default: false)")
+	srcInputFile = flag.String("srcInputFile", "", "Source input file to read from instead of srcVaultAddr,srceVaultToken (use with doCopy, doMirror)")
+	srcInputKvVersion = flag.Int("srcInputKvVersion", 0, "Kv api version (1 or 2) of the paths in srcInputFile (default: the destination Vault version, or 1 against a dstInputFile)")
+	srcVaultAddr = flag.String("srcVaultAddr", "", "Source Vault address (required except when using srcInputFile)")
+	srcVaultToken = flag.String("srcVaultToken", "", "Source Vault token (required except when using srcInputFile)")
+	dstVaultAddr = flag.String("dstVaultAddr", "", "Destination Vault address (required for doCopy, doMirror, doSync and doVerify)")
+	dstVaultToken = flag.String("dstVaultToken", "", "Destination Vault token (required for doCopy, doMirror, doSync and doVerify)")
+	retryMaxAttempts = flag.Int("retryMaxAttempts", 5, "Maximum attempts of a Vault request failing with a transient error (429, 5xx or network error)")
+	retryBaseBackoff = flag.Duration("retryBaseBackoff", 500*time.Millisecond, "Delay before the first retry of a Vault request (doubled for each further retry)")
+	retryMaxBackoff = flag.Duration("retryMaxBackoff", 30*time.Second, "Maximum delay between retries of a Vault request")
+	retryJitter = flag.Float64("retryJitter", 0.5, "Fraction (0 to 1) of each retry delay that is randomly removed to spread out retries")
+	srcRateLimit = flag.Float64("srcRateLimit", 0, "Maximum requests per second to the source Vault, shared by all workers (0 means no limit)")
+	srcRateBurst = flag.Int("srcRateBurst", 1, "Maximum burst of requests to the source Vault above srcRateLimit")
+	dstRateLimit = flag.Float64("dstRateLimit", 0, "Maximum requests per second to the destination Vault, shared by all workers (0 means no limit)")
+	dstRateBurst = flag.Int("dstRateBurst", 1, "Maximum burst of requests to the destination Vault above dstRateLimit")
+	adaptive = flag.Bool("adaptive", false, "Adapt the number of concurrent Vault requests between minWorkers and numWorkers to the Vault latency and throttling (default: false)")
+	minWorkers = flag.Int("minWorkers", 1, "Minimum number of concurrent Vault requests with adaptive")
+	adaptiveLatency = flag.Duration("adaptiveLatency", time.Second, "Vault request latency above which adaptive reduces the concurrency")
+	journalFile = flag.String("journalFile", "", "File to append each completed or failed write and delete to (use with doCopy, doMirror)")
+	resume = flag.Bool("resume", false, "Skip the writes and deletes that journalFile records as completed by an earlier run, retrying the failed ones (default: false)")
+	listTimeout = flag.Duration("listTimeout", 60*time.Second, "Timeout of each Vault list request (a timed out request is retried; 0 means no timeout)")
+	readTimeout = flag.Duration("readTimeout", 60*time.Second, "Timeout of each Vault read request, and of the setup requests like reading the mount table (a timed out request is retried; 0 means no timeout)")
+	writeTimeout = flag.Duration("writeTimeout", 60*time.Second, "Timeout of each Vault write or delete request (a timed out request is retried; 0 means no timeout)")
+	timeout = flag.Duration("timeout", 0, "Deadline for the whole run; the work not done by then is reported (0 means no deadline)")
+	doVerify = flag.Bool("doVerify", false, "Compare the source (Vault or srcInputFile) with the destination Vault by a hash of each secret's data, printing the missing, extra and mismatched paths (never values); the exit code is 3 when they differ (default: false)")
+	doDiff = flag.Bool("doDiff", false, "Like doVerify but also print the keys added, removed or changed in each differing secret, with values redacted as diffValues says (default: false)")
+	diffValues = flag.String("diffValues", "hash", "How doDiff shows values: \"hash\" (a salted sha256 prefix), \"mask\" (the first characters) or \"clear\" (the values themselves)")
+	diffSalt = flag.String("diffSalt", "", "Salt of the doDiff value hashes; set it to compare the hashes of several runs (default: a random salt)")
+	dstInputFile = flag.String("dstInputFile", "", "Destination listing file to verify or diff against instead of dstVaultAddr,dstVaultToken (use with doVerify, doDiff, doMerge)")
+	doMerge = flag.Bool("doMerge", false, "Merge the srcInputFile and dstInputFile listings into listOutputFile without contacting any Vault (default: false)")
+	mergePrecedence = flag.String("mergePrecedence", "source", "Which doMerge entry is kept for a path in both files: the \"source\" (srcInputFile) or \"destination\" (dstInputFile) one")
+	dstInputKvVersion = flag.Int("dstInputKvVersion", 0, "Kv api version (1 or 2) of the paths in dstInputFile (default: the source version)")
+	doSync = flag.Bool("doSync", false, "Two way sync: copy or delete the paths changed in one Vault since the last sync to the other one, reporting the paths changed in both (default: false)")
+	syncStateFile = flag.String("syncStateFile", "", "File keeping the hash of each path's data when both Vaults last agreed on it (required by doSync)")
+	conflictPolicy = flag.String("conflictPolicy", policyReport, "What doSync does with a path changed in both Vaults: \"report\" it, let the \"source\" win or let the \"newest\" (kv v2 updated_time) win")
+	stateFile = flag.String("stateFile", "", "File keeping the kv v2 version of each copied source secret so the next doCopy or doMirror only copies the secrets whose version moved (and finds the source deletions without listing the destination)")
+	watch = flag.Duration("watch", 0, "Run doCopy or doMirror again every interval (like 5m) until SIGINT or SIGTERM, logging only the changes (0 means run once)")
+	statusPort = flag.Int("statusPort", 0, "Http port serving the time and outcome of the last watch sync on GET /status (when > 0)")
+	gracePeriod = flag.Duration("gracePeriod", 30*time.Second, "Time the Vault requests in flight have to finish after SIGINT or SIGTERM before they are cancelled")
+	reportFile = flag.String("reportFile", "", "File to write a json report of the run to (counts, durations, failed paths; never secret values)")
+	listOutputFile = flag.String("listOutputFile", "/tmp/vaultcp.out", "File to write listing (suitable for use by srcInputFile)")
+	flag.StringVar(&version, "v", "false", "set to \"true\" to print current version and exit")
+
+	flag.Parse()
+
+	if version == "true" {
+		out = versionString
+		return out, err
+	}
+
+	if *doDiff {
+		*doVerify = true // a diff is a verify that also shows the key differences
+	}
+
+	if *numWorkers < 1 {
+		err = fmt.Errorf("Error: Illegal value %d for numWorkers; it must be > 0", *numWorkers)
+		return out, err
+	}
+
+	if *listTimeout < 0 || *readTimeout < 0 || *writeTimeout < 0 || *timeout < 0 {
+		err = fmt.Errorf("Error: listTimeout, readTimeout, writeTimeout and timeout must be >= 0")
+		return out, err
+	}
+
+	if *listWorkers < 0 {
+		err = fmt.Errorf("Error: Illegal value %d for listWorkers; it must be >= 0", *listWorkers)
+		return out, err
+	}
+
+	if *srcInputFile != "" && *srcVaultAddr != "" {
+		err = fmt.Errorf("Error: srcInputFile and srcVaultAddr are both defined. Use on or the other")
+		return out, err
+	}
+
+	if *listenPort < 0 {
+		err = fmt.Errorf("Error: Illegal listenPort value. It must be > 0 to act as a server listening on this port")
+		return out, err
+	} else if *listenPort == 0 && *srcInputFile == "" && *srcVaultAddr == "" {
+		err = fmt.Errorf("Error: srcInputFile or srcVaultAddr must be defined")
+		return out, err
+	}
+
+	if *srcInputFile != "" && *doCopy == false && *doMirror == false && *doVerify == false && *doMerge == false {
+		err = fmt.Errorf("Error: srcInputFile must be specified together with either doCopy, doMirror, doVerify or doMerge")
+		return out, err
+	}
+
+	if *doUpdate && *doCopy == false && *doMirror == false {
+		err = fmt.Errorf("Error: doUpdate must be specified together with either doCopy or doMirror")
+		return out, err
+	}
+
+	if *dryRun && *doCopy == false && *doMirror == false && *doSync == false {
+		err = fmt.Errorf("Error: dryRun must be specified together with either doCopy, doMirror or doSync")
+		return out, err
+	}
+
+	if *copyVersions && *srcInputFile != "" {
+		err = fmt.Errorf("Error: copyVersions requires srcVaultAddr (a srcInputFile only holds the latest versions)")
+		return out, err
+	}
+
+	if *retryMaxAttempts < 1 {
+		err = fmt.Errorf("Error: Illegal value %d for retryMaxAttempts; it must be > 0", *retryMaxAttempts)
+		return out, err
+	}
+
+	if *retryJitter < 0 || *retryJitter > 1 {
+		err = fmt.Errorf("Error: Illegal value %v for retryJitter; it must be between 0 and 1", *retryJitter)
+		return out, err
+	}
+
+	if *adaptive && (*minWorkers < 1 || *minWorkers > *numWorkers) {
+		err = fmt.Errorf("Error: Illegal value %d for minWorkers; it must be > 0 and <= numWorkers", *minWorkers)
+		return out, err
+	}
+
+	if *srcRateLimit < 0 || *dstRateLimit < 0 {
+		err = fmt.Errorf("Error: Illegal rate limit; srcRateLimit and dstRateLimit must be >= 0")
+		return out, err
+	}
+
+	if *srcRateBurst < 1 || *dstRateBurst < 1 {
+		err = fmt.Errorf("Error: Illegal rate burst; srcRateBurst and dstRateBurst must be > 0")
+		return out, err
+	}
+
+	if *watch < 0 {
+		err = fmt.Errorf("Error: Illegal value %s for watch; it must be >= 0", *watch)
+		return out, err
+	}
+
+	if *watch > 0 && (!(*doCopy || *doMirror || *doSync) || *dryRun || *resume || *srcInputFile != "" || *listenPort > 0) {
+		err = fmt.Errorf("Error: watch requires doCopy, doMirror or doSync from a source Vault and can not be combined with dryRun, resume or listenPort")
+		return out, err
+	}
+
+	if *stateFile != "" && (!(*doCopy || *doMirror) || *srcInputFile != "") {
+		err = fmt.Errorf("Error: stateFile requires doCopy or doMirror from a source Vault")
+		return out, err
+	}
+
+	if *doVerify && (*doCopy || *doMirror || *doSync || *dryRun) {
+		err = fmt.Errorf("Error: doVerify and doDiff can not be combined with doCopy, doMirror, doSync or dryRun")
+		return out, err
+	}
+
+	if *dstInputFile != "" && (!(*doVerify || *doMerge) || *dstVaultAddr != "") {
+		err = fmt.Errorf("Error: dstInputFile requires doVerify, doDiff or doMerge and can not be combined with dstVaultAddr")
+		return out, err
+	}
+
+	if *doMerge {
+		switch {
+		case *srcInputFile == "" || *dstInputFile == "":
+			err = fmt.Errorf("Error: doMerge requires srcInputFile and dstInputFile")
+		case *doCopy || *doMirror || *doSync || *doVerify || *dryRun || *watch > 0:
+			err = fmt.Errorf("Error: doMerge can not be combined with doCopy, doMirror, doSync, doVerify, doDiff, dryRun or watch")
+		case *mergePrecedence != "source" && *mergePrecedence != "destination":
+			err = fmt.Errorf("Error: Illegal value %s for mergePrecedence; it must be \"source\" or \"destination\"", *mergePrecedence)
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+
+	if *dstInputKvVersion < 0 || *dstInputKvVersion > 2 {
+		err = fmt.Errorf("Error: Illegal value %d for dstInputKvVersion; it must be 1 or 2", *dstInputKvVersion)
+		return out, err
+	}
+
+	if *diffValues != "hash" && *diffValues != "mask" && *diffValues != "clear" {
+		err = fmt.Errorf("Error: Illegal value %s for diffValues; it must be \"hash\", \"mask\" or \"clear\"", *diffValues)
+		return out, err
+	}
+	if *doDiff && *diffValues == "hash" && *diffSalt == "" {
+		salt := make([]byte, 16)
+		_, err = crand.Read(salt)
 		if err != nil {
-			log.Printf("%s", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return out, err
 		}
-	*/
-
-	w.WriteHeader(http.StatusOK)
-}
+		*diffSalt = hex.EncodeToString(salt)
+	}
 
-func copyFromVaultHandler(w http.ResponseWriter, r *http.Request) {
-	if working {
-		w.WriteHeader(http.StatusForbidden)
-		io.WriteString(w, "busy: try again later")
-		return
+	if *statusPort > 0 && *watch == 0 {
+		err = fmt.Errorf("Error: statusPort requires watch")
+		return out, err
 	}
-	setWorking(true)
-	defer setWorking(false)
 
-	vars := mux.Vars(r)
+	if *resume && *journalFile == "" {
+		err = fmt.Errorf("Error: resume requires journalFile")
+		return out, err
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	if *srcInputKvVersion < 0 || *srcInputKvVersion > 2 {
+		err = fmt.Errorf("Error: Illegal value %d for srcInputKvVersion; it must be 1 or 2", *srcInputKvVersion)
+		return out, err
+	}
 
-	msg := fmt.Sprintf("{\"copyFromVault\":{\"srcaddr\":\"%s\",\"dstaddr\":\"%s\"}}",
-		vars["srcaddr"], vars["dstaddr"])
-	io.WriteString(w, msg)
-}
+	err = loadRewriteRules()
+	if err != nil {
+		return out, err
+	}
 
-func flags() (out string, err error) {
-	kvRootFlag = flag.String("kvRootFlag", "", "Root of secret path to consider. Set to like \"secret/skydrivedev\" (or appropriate)  when using a non-admin token (can't discover from the real kv root mount point)")
+	if len(mounts) > 0 {
+		*allMounts = true
+	}
 
-	listenPort = flag.Int("listenPort", 0, "Http Listen port (when > 0 act as a server)")
-	numWorkers = flag.Int("numWorkers", 10, "Number of workers to enable parallel execution")
-	doCopy = flag.Bool("doCopy", false, "Copy the secrets from the source to destination Vault (default: false)")
-	doMirror = flag.Bool("doMirror", false, "Like doCopy but destination Vault entries not in the source Vault will be deleted (default: false)")
-	srcInputFile = flag.String("srcInputFile", "", "Source input file to read from instead of srcVaultAddr,srceVaultToken (use with doCopy, doMirror)")
-	srcVaultAddr = flag.String("srcVaultAddr", "", "Source Vault address (required except when using srcInputFile)")
-	srcVaultToken = flag.String("srcVaultToken", "", "Source Vault token (required except when using srcInputFile)")
-	dstVaultAddr = flag.String("dstVaultAddr", "", "Destination Vault address (required for doCopy and doMirror)")
-	dstVaultToken = flag.String("dstVaultToken", "", "Destination Vault token (required for doCopy and doMirror)")
-	listOutputFile = flag.String("listOutputFile", "/tmp/vaultcp.out", "File to write listing (suitable for use by srcInputFile)")
-	flag.StringVar(&version, "v", "false", "set to \"true\" to print current version and exit")
+	// checked once the rewrite rules and the mounts are loaded
+	if *doSync {
+		switch {
+		case *doCopy || *doMirror:
+			err = fmt.Errorf("Error: doSync can not be combined with doCopy or doMirror")
+		case *syncStateFile == "":
+			err = fmt.Errorf("Error: doSync requires syncStateFile")
+		case *srcInputFile != "" || *allMounts || hasRewriteRules():
+			err = fmt.Errorf("Error: doSync requires a source Vault and can not be combined with allMounts, mounts or rewrite rules")
+		case *journalFile != "" || *stateFile != "" || *copyVersions || *withMetadata:
+			err = fmt.Errorf("Error: doSync can not be combined with journalFile, stateFile, copyVersions or withMetadata")
+		case *conflictPolicy != policyReport && *conflictPolicy != policySource && *conflictPolicy != policyNewest:
+			err = fmt.Errorf("Error: Illegal conflictPolicy %s; it must be report, source or newest", *conflictPolicy)
+		}
+		if err != nil {
+			return out, err
+		}
+	}
 
-	flag.Parse()
+	err = loadFilters()
+	if err != nil {
+		return out, err
+	}
 
-	if version == "true" {
-		out = versionString
+	if hasFilters() && hasRewriteRules() && *doMirror {
+		err = fmt.Errorf("Error: filters can not be combined with rewrite rules in doMirror mode (the excluded destination paths would be unknown)")
 		return out, err
 	}
 
-	if *numWorkers < 1 {
-		err = fmt.Errorf("Error: Illegal value %d for numWorkers; it must be > 0", *numWorkers)
+	if hasRewriteRules() && *doMirror && *dstKvRootFlag == "" {
+		err = fmt.Errorf("Error: rewrite rules in doMirror mode require dstKvRootFlag (the destination subtree the rewritten paths are mirrored to)")
 		return out, err
 	}
 
-	if *srcInputFile != "" && *srcVaultAddr != "" {
-		err = fmt.Errorf("Error: srcInputFile and srcVaultAddr are both defined. Use on or the other")
+	if *allMounts && (*kvRootFlag != "" || *dstKvRootFlag != "") {
+		err = fmt.Errorf("Error: allMounts can not be combined with kvRootFlag or dstKvRootFlag")
 		return out, err
 	}
 
-	if *listenPort < 0 {
-		err = fmt.Errorf("Error: Illegal listenPort value. It must be > 0 to act as a server listening on this port")
+	if *allMounts && *dstInputFile != "" {
+		err = fmt.Errorf("Error: allMounts can not be combined with dstInputFile")
 		return out, err
-	} else if *listenPort == 0 && *srcInputFile == "" && *srcVaultAddr == "" {
-		err = fmt.Errorf("Error: srcInputFile or srcVaultAddr must be defined")
+	}
+
+	if *allMounts && hasRewriteRules() {
+		err = fmt.Errorf("Error: allMounts can not be combined with rewrite rules")
 		return out, err
 	}
 
-	if *srcInputFile != "" && *doCopy == false && *doMirror == false {
-		err = fmt.Errorf("Error: srcInputFile must be specified together with either doCopy or doMirror")
+	if *planFormat != "text" && *planFormat != "json" {
+		err = fmt.Errorf("Error: Illegal value %s for planFormat; it must be \"text\" or \"json\"", *planFormat)
 		return out, err
 	}
 
@@ -677,10 +3703,31 @@ func flags() (out string, err error) {
 func prepForAction() (err error) {
 	var srcKvApi bool
 	var srcKvRoot string
-	var dstKvApi bool
-	var dstKvRoot string
 
-	if *doCopy || *doMirror {
+	if *dstInputFile != "" {
+		// verifying against a listing file: the kv api versions of the files come from the flags
+		if *srcVaultAddr != "" {
+			kvApi, kvRoot, kvMountPath, err = fetchVersionInfo(srcClients[0], *kvRootFlag)
+			if err != nil {
+				err = fmt.Errorf("Error fetching version info: %s", err)
+				return err
+			}
+		} else {
+			kvApi = *srcInputKvVersion == 2
+			kvRoot = *kvRootFlag
+			kvMountPath = "" // the mount lines of the files tell (else the mount is the first path segment)
+		}
+		dstKvApi = kvApi
+		if *dstInputKvVersion > 0 {
+			dstKvApi = *dstInputKvVersion == 2
+		}
+		dstKvRoot = kvRoot
+		dstMountPath = kvMountPath
+		if *dstKvRootFlag != "" {
+			dstKvRoot = *dstKvRootFlag
+			dstMountPath = ""
+		}
+	} else if *doCopy || *doMirror || *doSync || *doVerify {
 		if *dstVaultAddr == "" {
 			err = fmt.Errorf("Unspecified dstVaultAddr")
 			return err
@@ -691,24 +3738,28 @@ func prepForAction() (err error) {
 			return err
 		}
 
-		dstKvApi, dstKvRoot, err = fetchVersionInfo(dstClients[0])
+		dstRootFlag := *dstKvRootFlag
+		if dstRootFlag == "" {
+			dstRootFlag = *kvRootFlag
+		}
+		dstKvApi, dstKvRoot, dstMountPath, err = fetchVersionInfo(dstClients[0], dstRootFlag)
 		if err != nil {
 			err = fmt.Errorf("Error fetching version info: %s", err)
 			return err
 		}
 
 		if *srcVaultAddr != "" {
-			srcKvApi, srcKvRoot, err = fetchVersionInfo(srcClients[0])
+			srcKvApi, srcKvRoot, kvMountPath, err = fetchVersionInfo(srcClients[0], *kvRootFlag)
 			if err != nil {
 				err = fmt.Errorf("Error fetching version info: %s", err)
 				return err
 			}
 			if dstKvApi != srcKvApi {
-				err = fmt.Errorf("The Vault kv api is different betwen the source and destination Vaults")
-				return err
+				log.Printf("Info: Translating between the kv v%d api of the source and the kv v%d api of the destination Vault\n",
+					kvVersion(srcKvApi), kvVersion(dstKvApi))
 			}
-			if dstKvRoot != srcKvRoot {
-				err = fmt.Errorf("The Vault kv root is different betwen the source and destination Vaults\n")
+			if dstKvRoot != srcKvRoot && !hasRewriteRules() && !*allMounts && !*doSync {
+				err = fmt.Errorf("The Vault kv root is different betwen the source and destination Vaults (use rewrite rules to copy between them)\n")
 				return err
 			}
 			kvApi = srcKvApi
@@ -719,12 +3770,16 @@ func prepForAction() (err error) {
 		} else {
 			// we will read from srcInputFile
 			kvApi = dstKvApi
+			if *srcInputKvVersion > 0 {
+				kvApi = *srcInputKvVersion == 2
+			}
 			kvRoot = dstKvRoot
+			kvMountPath = dstMountPath
 		}
 	} else {
 		// listing src vault mode
 		if *srcVaultAddr != "" {
-			srcKvApi, srcKvRoot, err = fetchVersionInfo(srcClients[0])
+			srcKvApi, srcKvRoot, kvMountPath, err = fetchVersionInfo(srcClients[0], *kvRootFlag)
 			if err != nil {
 				err = fmt.Errorf("Error fetching version info: %s", err)
 				return err
@@ -736,34 +3791,53 @@ func prepForAction() (err error) {
 	return err // nil
 }
 
+func kvVersion(v2 bool) int {
+	if v2 {
+		return 2
+	}
+	return 1
+}
+
+// newLimiter returns a rate limiter of requestsPerSecond with burst, or nil (no limit) when requestsPerSecond is 0
+func newLimiter(requestsPerSecond float64, burst int) *rate.Limiter {
+	if requestsPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+}
+
 func prepConnections() (err error) {
 	var srcClient *api.Client
 	var dstClient *api.Client
 
+	concurrency = nil
+	if *adaptive {
+		concurrency = newAdaptiveLimiter(*minWorkers, *numWorkers, *adaptiveLatency)
+	}
+
+	// The limiters are shared by all the clients of a Vault so the rate limit holds across the workers
+	srcLimiter := newLimiter(*srcRateLimit, *srcRateBurst)
+	dstLimiter := newLimiter(*dstRateLimit, *dstRateBurst)
+
+	rateLimiters = map[*api.Client]*rate.Limiter{}
 	srcClients = make([]*api.Client, *numWorkers)
 	dstClients = make([]*api.Client, *numWorkers)
 	for i := 0; i < *numWorkers; i++ {
 		if *srcVaultAddr != "" {
-			srcClient, err = api.NewClient(&api.Config{
-				Address: *srcVaultAddr,
-			})
+			srcClient, err = newClient(*srcVaultAddr, *srcVaultToken, srcLimiter)
 			if err != nil {
 				err = fmt.Errorf("Error from vault NewClient : %s\n", err)
 				return err
 			}
-			srcClient.SetToken(*srcVaultToken)
 			srcClients[i] = srcClient
 		} // else we do not need srcClient connections as we will read from srcInputFile
 
-		if *doCopy || *doMirror {
-			dstClient, err = api.NewClient(&api.Config{
-				Address: *dstVaultAddr,
-			})
+		if (*doCopy || *doMirror || *doSync || *doVerify) && *dstInputFile == "" {
+			dstClient, err = newClient(*dstVaultAddr, *dstVaultToken, dstLimiter)
 			if err != nil {
 				err = fmt.Errorf("Error from vault NewClient : %s\n", err)
 				return err
 			}
-			dstClient.SetToken(*dstVaultToken)
 			dstClients[i] = dstClient
 		}
 	}
@@ -771,25 +3845,133 @@ func prepConnections() (err error) {
 	return err // nil
 }
 
+// newClient creates a Vault client sharing limiter with the other clients of its Vault
+// The client has no timeout of its own: the requests made with vaultRequest are bounded by listTimeout, readTimeout
+// or writeTimeout (see setupClient for the others)
+func newClient(addr, token string, limiter *rate.Limiter) (client *api.Client, err error) {
+	config := &api.Config{
+		Address: addr,
+	}
+	client, err = api.NewClient(config)
+	if err != nil {
+		return client, err
+	}
+	config.HttpClient.Timeout = 0 // the default http client times out after 60s
+	client.SetToken(token)
+	if limiter != nil {
+		// vaultRequest waits for the limiter itself: the api client would send the request unthrottled
+		// when the wait can not end before the deadline of the request
+		rateLimiters[client] = limiter
+	}
+	return client, err
+}
+
+// setupClient returns a copy of client whose requests are bounded by readTimeout, for the requests of the setup
+// that do not go through vaultRequest (like reading the mount table)
+func setupClient(client *api.Client) (setup *api.Client, err error) {
+	setup, err = client.Clone()
+	if err != nil {
+		return setup, err
+	}
+	setup.SetClientTimeout(*readTimeout)
+	setup.SetToken(client.Token())
+	return setup, err
+}
+
+// listPath returns the path to list for a kv root (the metadata path for the kv v2 api)
+func listPath(root, mount string, v2 bool) (path string) {
+	if !v2 {
+		return root
+	}
+	root = strings.TrimRight(root, "/")
+	mount = pathMount(root, mount)
+	rest := strings.TrimPrefix(strings.TrimPrefix(root, mount), "/")
+	if rest == "" {
+		return mount + "/metadata"
+	}
+	return mount + "/metadata/" + rest
+}
+
 /*
  * Depends on prepConnections and prepForAction having been previously invoked
  */
-func doAction() (err error) {
-	var path string
-	if kvApi {
-		kvRoot = strings.TrimRight(kvRoot, "/")
-		if strings.Count(kvRoot, "/") > 0 {
-			kvRootSplit := strings.Split(kvRoot, "/")
-			path = fmt.Sprintf("%s/metadata/%s", kvRootSplit[0], strings.Join(kvRootSplit[1:], "/"))
-		} else {
-			path = fmt.Sprintf("%s/metadata", kvRoot)
+func doAction(ctx context.Context) (err error) {
+	failuresMu.Lock()
+	failures = nil
+	failuresMu.Unlock()
+
+	defer func() {
+		logDetail("Info: %d Vault requests were retried\n", atomic.LoadInt64(&retryCount))
+		if concurrency != nil {
+			logDetail("Info: Adaptive concurrency settled at %d (between %d and %d)\n", concurrency.current(), *minWorkers, *numWorkers)
 		}
-	} else {
-		path = kvRoot
+		if why := stopErr(ctx); why != nil {
+			log.Printf("Info: The run stopped early (%s); the secrets not yet copied or deleted will be handled by the next run (with -resume when journalFile is set)\n", why)
+		}
+		printFailures()
+		if err == nil && len(failures) > 0 {
+			err = errSecretsFailed
+		}
+	}()
+
+	if *doMerge {
+		return mergeListings()
+	}
+
+	if *doSync {
+		err = twoWaySync(ctx)
+		if err != nil {
+			err = fmt.Errorf("Error syncing secrets: %s", err)
+		}
+		return err
+	}
+
+	state = nil
+	if (*doCopy || *doMirror) && *stateFile != "" {
+		err = loadState()
+		if err != nil {
+			err = fmt.Errorf("Error reading state file %s: %s", *stateFile, err)
+			return err
+		}
+		if !*dryRun {
+			defer func() {
+				serr := saveState()
+				if serr != nil {
+					log.Printf("Error writing state file %s: %s\n", *stateFile, serr)
+					if err == nil {
+						err = serr
+					}
+				}
+			}()
+		}
+	}
+
+	if *allMounts {
+		return doActionAllMounts(ctx)
+	}
+
+	path := listPath(kvRoot, kvMountPath, kvApi)
+
+	if *doVerify {
+		err = verify(ctx, path, listPath(dstKvRoot, dstMountPath, dstKvApi))
+		if err != nil && err != errDifferent {
+			err = fmt.Errorf("Error verifying secrets: %s", err)
+		}
+		return err
 	}
 
 	if *doCopy || *doMirror {
-		err = copy(path)
+		if *journalFile != "" && !*dryRun {
+			err = openJournal()
+			if err != nil {
+				err = fmt.Errorf("Error opening journal file %s: %s", *journalFile, err)
+				return err
+			}
+			defer closeJournal()
+		}
+
+		dstPath := listPath(dstKvRoot, dstMountPath, dstKvApi)
+		err = copy(ctx, path, dstPath)
 		if err != nil {
 			err = fmt.Errorf("Error copying secrets: %s", err)
 			return err
@@ -802,7 +3984,7 @@ func doAction() (err error) {
 		}
 		defer listFile.Close()
 
-		err = list2(path)
+		err = list2(ctx, path)
 		if err != nil {
 			err = fmt.Errorf("Error listing secrets: %s", err)
 			return err
@@ -811,6 +3993,248 @@ func doAction() (err error) {
 	return err // nil
 }
 
+/*
+ * Like doAction but for every selected kv mount, one mount at a time
+ * The kv api version of each mount comes from its mount options (or from the listing file mount lines)
+ */
+func doActionAllMounts(ctx context.Context) (err error) {
+	if !*doCopy && !*doMirror && !*doVerify {
+		srcMounts, err := listKvMounts(ctx, srcClients[0])
+		if err != nil {
+			return fmt.Errorf("Error listing source mounts: %s", err)
+		}
+		if len(srcMounts) == 0 {
+			return noMountsError()
+		}
+
+		listFile, err = os.Create(*listOutputFile)
+		if err != nil {
+			err = fmt.Errorf("Error creating list output file %s: %s", *listOutputFile, err)
+			return err
+		}
+		defer listFile.Close()
+
+		for _, m := range srcMounts {
+			log.Printf("Info: Listing kv v%d mount %s\n", kvVersion(m.V2), m.Path)
+			kvRoot = m.Path
+			kvMountPath = strings.TrimSuffix(m.Path, "/")
+			kvApi = m.V2
+			_, err = listFile.WriteString(mountLine(m))
+			if err != nil {
+				return err
+			}
+			err = list2(ctx, listPath(kvRoot, kvMountPath, kvApi))
+			if err != nil {
+				return fmt.Errorf("Error listing secrets of mount %s: %s", m.Path, err)
+			}
+		}
+		return err // nil
+	}
+
+	if *journalFile != "" && !*dryRun && !*doVerify {
+		err = openJournal()
+		if err != nil {
+			err = fmt.Errorf("Error opening journal file %s: %s", *journalFile, err)
+			return err
+		}
+		defer closeJournal()
+	}
+
+	var srcMounts []kvMount
+	if *srcInputFile != "" {
+		srcMounts, err = listFileMounts()
+	} else {
+		srcMounts, err = listKvMounts(ctx, srcClients[0])
+	}
+	if err != nil {
+		return fmt.Errorf("Error listing source mounts: %s", err)
+	}
+	if len(srcMounts) == 0 {
+		return noMountsError()
+	}
+
+	dstMounts, err := listKvMounts(ctx, dstClients[0])
+	if err != nil {
+		return fmt.Errorf("Error listing destination mounts: %s", err)
+	}
+	dstV2 := map[string]bool{}
+	for _, m := range dstMounts {
+		dstV2[m.Path] = m.V2
+	}
+
+	var missing []string
+	differs := false
+	for _, m := range srcMounts {
+		v2, ok := dstV2[m.Path]
+		if !ok {
+			log.Printf("Error: mount %s is missing from the destination Vault\n", m.Path)
+			missing = append(missing, m.Path)
+			continue
+		}
+		if *doVerify {
+			logDetail("Info: Verifying kv v%d mount %s against kv v%d mount %s\n", kvVersion(m.V2), m.Path, kvVersion(v2), m.Path)
+		} else {
+			logDetail("Info: Copying kv v%d mount %s to kv v%d mount %s\n", kvVersion(m.V2), m.Path, kvVersion(v2), m.Path)
+		}
+		kvRoot = m.Path
+		kvMountPath = strings.TrimSuffix(m.Path, "/")
+		kvApi = m.V2
+		dstKvRoot = m.Path
+		dstMountPath = strings.TrimSuffix(m.Path, "/")
+		dstKvApi = v2
+		fileMount = m.Path
+		if *doVerify {
+			err = verify(ctx, listPath(kvRoot, kvMountPath, kvApi), listPath(dstKvRoot, dstMountPath, dstKvApi))
+			if err == errDifferent {
+				differs = true
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("Error verifying secrets of mount %s: %s", m.Path, err)
+			}
+			continue
+		}
+		err = copy(ctx, listPath(kvRoot, kvMountPath, kvApi), listPath(dstKvRoot, dstMountPath, dstKvApi))
+		if err != nil {
+			return fmt.Errorf("Error copying secrets of mount %s: %s", m.Path, err)
+		}
+	}
+
+	if len(missing) > 0 {
+		err = fmt.Errorf("Error: mounts missing from the destination Vault were not copied: %s", strings.Join(missing, ", "))
+	} else if differs {
+		err = errDifferent
+	}
+	return err
+}
+
+// syncStatus is the time and outcome of the last watch mode sync, served as json on statusPort
+type syncStatus struct {
+	Syncs   int            `json:"syncs"`
+	Start   time.Time      `json:"start"`
+	End     time.Time      `json:"end"`
+	Outcome string         `json:"outcome"` // ok, failures (some secrets failed), stopped (by SIGINT or SIGTERM) or error
+	Error   string         `json:"error,omitempty"`
+	Counts  map[string]int `json:"counts"`
+	Next    time.Time      `json:"next"`
+}
+
+var (
+	lastSync   syncStatus
+	lastSyncMu sync.Mutex
+)
+
+/*
+ * runWatch copies or mirrors every watch interval until a signal (or the timeout deadline) stops it
+ * The connections and the kv versions found by the setup are reused by every sync
+ * A failed sync is logged and the next one is still run
+ */
+func runWatch(ctx context.Context) (err error) {
+	if *statusPort > 0 {
+		go runStatusServer()
+	}
+
+	for {
+		report = newReport()
+		atomic.StoreInt64(&retryCount, 0)
+
+		err = doAction(ctx)
+
+		outcome := "ok"
+		switch {
+		case err != nil && interrupted():
+			outcome = "stopped" // a requested stop is not a failed sync
+		case err == errSecretsFailed:
+			outcome = "failures"
+		case err != nil:
+			outcome = "error"
+			log.Printf("%s\n", err)
+		}
+		code := exitOK
+		reportErr := err
+		switch outcome {
+		case "stopped":
+			code = exitInterrupted
+			reportErr = nil
+		case "failures":
+			code = exitSecretsFailed
+		case "error":
+			code = exitFatal
+		}
+		if *reportFile != "" {
+			rerr := writeReport(code, reportErr)
+			if rerr != nil {
+				log.Printf("Error writing report file %s: %s\n", *reportFile, rerr)
+			}
+		}
+
+		report.mu.Lock()
+		counts := map[string]int{}
+		for k, n := range report.Counts {
+			counts[k] = n
+		}
+		report.mu.Unlock()
+		failuresMu.Lock()
+		counts["failed"] = len(failures)
+		failuresMu.Unlock()
+		log.Printf("Info: Sync %s: %d created, %d updated, %d deleted, %d failed\n",
+			outcome, counts["created"], counts["updated"], counts["deleted"], counts["failed"])
+
+		lastSyncMu.Lock()
+		lastSync.Syncs++
+		lastSync.Start = report.Start
+		lastSync.End = time.Now()
+		lastSync.Outcome = outcome
+		lastSync.Error = ""
+		if outcome == "error" {
+			lastSync.Error = err.Error()
+		}
+		lastSync.Counts = counts
+		lastSync.Next = lastSync.Start.Add(*watch)
+		next := lastSync.Next
+		lastSyncMu.Unlock()
+
+		if interrupted() {
+			log.Printf("Info: Watch mode stopped\n")
+			return nil
+		}
+		if stopErr(ctx) != nil {
+			return stopErr(ctx)
+		}
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-stopped:
+			log.Printf("Info: Watch mode stopped\n")
+			return nil
+		case <-ctx.Done():
+			return stopErr(ctx)
+		}
+	}
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	lastSyncMu.Lock()
+	ba, err := json.Marshal(lastSync)
+	lastSyncMu.Unlock()
+	if err != nil {
+		log.Printf("%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ba)
+}
+
+// runStatusServer serves the last sync status of watch mode
+func runStatusServer() {
+	r := mux.NewRouter()
+	r.HandleFunc("/status", statusHandler).Methods(http.MethodGet)
+	addr := fmt.Sprintf("localhost:%d", *statusPort)
+	log.Fatal(http.ListenAndServe(addr, r))
+}
+
 func runServer() {
 	r := mux.NewRouter()
 	r.HandleFunc("/health", healthHandler).Methods(http.MethodGet)
@@ -827,11 +4251,11 @@ func main() {
 	out, err := flags()
 	if err != nil {
 		log.Printf("%s", err)
-		os.Exit(1)
+		os.Exit(exitFatal)
 	}
 	if out != "" {
 		log.Printf("%s", out)
-		os.Exit(0)
+		os.Exit(exitOK)
 	}
 
 	if *listenPort > 0 {
@@ -840,21 +4264,102 @@ func main() {
 
 	// This tool is running in client mode so only a single action will be performed (a list or copy of one flavor or another)
 	// This sequence will be the same for each web request (assuming no outstanding request is in progress)
+	endSetup := report.phase("setup", "")
 	err = prepConnections()
 	if err != nil {
-		log.Printf("%s", err)
-		os.Exit(1)
+		exit(exitFatal, err)
 	}
 
 	err = prepForAction()
 	if err != nil {
-		log.Printf("%s", err)
-		os.Exit(1)
+		exit(exitFatal, err)
+	}
+	endSetup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if *timeout > 0 {
+		// the deadline counts from the start of the process so it includes the setup
+		ctx, cancel = context.WithDeadline(context.Background(), report.Start.Add(*timeout))
+	}
+	defer cancel()
+	handleSignals(cancel)
+
+	if *watch > 0 {
+		err = runWatch(ctx)
+		if interrupted() && err != nil {
+			exit(exitInterrupted, err)
+		}
+		if err != nil {
+			exit(exitFatal, err)
+		}
+		os.Exit(exitOK) // the report of the last sync is already written
+	}
+
+	err = doAction(ctx)
+	if interrupted() {
+		exit(exitInterrupted, err)
 	}
+	if err == errSecretsFailed {
+		exit(exitSecretsFailed, err)
+	}
+	if err == errDifferent {
+		exit(exitDifferent, err)
+	}
+	if err != nil {
+		exit(exitFatal, err)
+	}
+	exit(exitOK, err)
+}
+
+// stopErr returns why no new work should be started (the run was interrupted or its deadline passed) or nil
+func stopErr(ctx context.Context) error {
+	switch {
+	case interrupted():
+		return errInterrupted
+	case ctx.Err() == context.DeadlineExceeded:
+		return errDeadline
+	}
+	return ctx.Err()
+}
 
-	err = doAction()
+// interrupted reports whether a signal asked the run to stop
+func interrupted() bool {
+	select {
+	case <-stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleSignals stops the dispatching of new work on SIGINT or SIGTERM and cancels the Vault requests still in flight
+// gracePeriod later (or on a second signal)
+func handleSignals(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Info: Received %s: no new work will be started and the requests in flight have %s to finish (send it again to stop now)\n", sig, *gracePeriod)
+		close(stopped)
+		select {
+		case <-sigs:
+		case <-time.After(*gracePeriod):
+		}
+		log.Printf("Info: Cancelling the requests in flight\n")
+		cancel()
+	}()
+}
+
+// exit logs the error (if any), writes the run report (if enabled) and exits with code
+func exit(code int, err error) {
 	if err != nil {
 		log.Printf("%s", err)
-		os.Exit(1)
 	}
+	if *reportFile != "" {
+		rerr := writeReport(code, err)
+		if rerr != nil {
+			log.Printf("Error writing report file %s: %s", *reportFile, rerr)
+		}
+	}
+	os.Exit(code)
 }
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func setFilters(t *testing.T, f ...string) {
+	t.Helper()
+	filters = stringList(f)
+	if err := loadFilters(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchSegs(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/*", "a/b", true},
+		{"a/*", "a/b/c", false},
+		{"a/**", "a", true},
+		{"a/**", "a/b/c", true},
+		{"**/c", "a/b/c", true},
+		{"**/c", "c", true},
+		{"a/**/d", "a/b/c/d", true},
+		{"a/**/d", "a/b/c", false},
+		{"dev-*", "dev-app", true},
+		{"dev-*", "prod-app", false},
+	}
+	for _, tt := range tests {
+		got := matchSegs(strings.Split(tt.pattern, "/"), strings.Split(tt.path, "/"))
+		if got != tt.want {
+			t.Errorf("matchSegs(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPathSelected(t *testing.T) {
+	tests := []struct {
+		filters []string
+		path    string
+		want    bool
+	}{
+		{nil, "a/b", true},
+		{[]string{"app"}, "app/x", true},
+		{[]string{"app"}, "other/x", false},
+		{[]string{"app/*"}, "app/x", true},
+		{[]string{"app/*"}, "app/x/y", true},
+		{[]string{"!app/tmp"}, "app/x", true},
+		{[]string{"!app/tmp"}, "app/tmp", false},
+		{[]string{"!app/tmp"}, "app/tmp/x", false},
+		{[]string{"!app/tmp"}, "app/tmp/x/y", false},
+		{[]string{"!**/tmp"}, "a/b/tmp/x", false},
+		{[]string{"app", "!app/tmp"}, "app/x", true},
+		{[]string{"app", "!app/tmp"}, "app/tmp/x", false},
+	}
+	for _, tt := range tests {
+		setFilters(t, tt.filters...)
+		if got := pathSelected(tt.path); got != tt.want {
+			t.Errorf("pathSelected(%q) with %v = %v, want %v", tt.path, tt.filters, got, tt.want)
+		}
+	}
+	setFilters(t)
+}
+
+func TestPruneFolder(t *testing.T) {
+	tests := []struct {
+		filters []string
+		folder  string
+		want    bool
+	}{
+		{nil, "a", false},
+		{[]string{"app/x"}, "app", false},
+		{[]string{"app/x"}, "other", true},
+		{[]string{"app/x"}, "app/y", true},
+		{[]string{"app/**/x"}, "app/y/z", false},
+		{[]string{"!app/tmp"}, "app/tmp", true},
+		{[]string{"!app/tmp"}, "app", false},
+	}
+	for _, tt := range tests {
+		setFilters(t, tt.filters...)
+		if got := pruneFolder(tt.folder); got != tt.want {
+			t.Errorf("pruneFolder(%q) with %v = %v, want %v", tt.folder, tt.filters, got, tt.want)
+		}
+	}
+	setFilters(t)
+}
+
+func TestRelPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		mount string
+		v2    bool
+		want  string
+	}{
+		{"secret/a/b", "secret", false, "a/b"},
+		{"secret/metadata/a/b", "secret", true, "a/b"},
+		{"secret/data/a/b", "secret", true, "a/b"},
+		{"secret/metadata", "secret", true, ""},
+		{"team/kv/metadata/a", "team/kv", true, "a"},
+		{"team/kv/a", "team/kv", false, "a"},
+		{"other/a", "team/kv", false, "a"},
+		{"secret", "secret", false, ""},
+	}
+	for _, tt := range tests {
+		if got := relPath(tt.path, tt.mount, tt.v2); got != tt.want {
+			t.Errorf("relPath(%q, %q, %v) = %q, want %q", tt.path, tt.mount, tt.v2, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base, max, jitter := time.Second, 10*time.Second, 0.0
+	retryBaseBackoff, retryMaxBackoff, retryJitter = &base, &max, &jitter
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+
+	jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := backoff(2); got <= time.Second || got > 2*time.Second {
+			t.Fatalf("backoff(2) with jitter 0.5 = %s, want in (1s, 2s]", got)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&api.ResponseError{StatusCode: http.StatusTooManyRequests}, true},
+		{&api.ResponseError{StatusCode: http.StatusInternalServerError}, true},
+		{&api.ResponseError{StatusCode: http.StatusBadGateway}, true},
+		{&api.ResponseError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&api.ResponseError{StatusCode: http.StatusGatewayTimeout}, true},
+		{&api.ResponseError{StatusCode: http.StatusBadRequest}, false},
+		{&api.ResponseError{StatusCode: http.StatusForbidden}, false},
+		{&api.ResponseError{StatusCode: http.StatusNotImplemented}, false},
+		{&url.Error{Op: "Get", URL: "http://vault", Err: context.DeadlineExceeded}, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{context.Canceled, false},
+		{errors.New("Illegal version"), false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%#v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestAdaptiveLimiterAcquire(t *testing.T) {
+	l := newAdaptiveLimiter(1, 1, time.Second)
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("acquire of a full limiter with a deadline = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	done := make(chan error)
+	go func() { done <- l.acquire(context.Background()) }()
+	l.release(time.Millisecond, nil)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("acquire after a release = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("acquire still waits after a release")
+	}
+}
+
+func TestDeletedUnder(t *testing.T) {
+	kvMountPath = "team/kv"
+	defer func() { kvMountPath = "" }()
+	setFilters(t)
+	st := &syncState{Versions: map[string]secretVersion{}, seen: map[string]bool{}, pending: map[string]string{}}
+	for _, k := range []string{"team/kv/data/app/a", "team/kv/data/app/b", "team/kv/data/apple/c", "team/kv/data/other/d"} {
+		st.Versions[k] = secretVersion{}
+	}
+	st.seen["team/kv/data/app/a"] = true
+
+	tests := []struct {
+		root string
+		want []string
+	}{
+		{"team/kv/", []string{"team/kv/data/app/b", "team/kv/data/apple/c", "team/kv/data/other/d"}},
+		{"team/kv/app", []string{"team/kv/data/app/b"}},
+		{"team/kv/app/", []string{"team/kv/data/app/b"}},
+		{"team/kv/none", nil},
+	}
+	for _, tt := range tests {
+		if got := st.deletedUnder(tt.root); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("deletedUnder(%q) = %v, want %v", tt.root, got, tt.want)
+		}
+	}
+
+	setFilters(t, "!other")
+	if got := st.deletedUnder("team/kv/"); strings.Join(got, ",") != "team/kv/data/app/b,team/kv/data/apple/c" {
+		t.Errorf("deletedUnder with an exclude filter = %v", got)
+	}
+	setFilters(t)
+}
+
+func TestSyncPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		root  string
+		mount string
+		v2    bool
+		rel   string
+	}{
+		{"secret/data/a/b", "secret/", "secret", true, "a/b"},
+		{"secret/data/skydrivedev/a", "secret/skydrivedev", "secret", true, "a"},
+		{"secret/skydrivedev/a", "secret/skydrivedev", "secret", false, "a"},
+		{"team/kv/data/app/x/y", "team/kv/app/", "team/kv", true, "x/y"},
+	}
+	for _, tt := range tests {
+		rel := rootRelPath(tt.path, tt.root, tt.mount, tt.v2)
+		if rel != tt.rel {
+			t.Errorf("rootRelPath(%q, %q) = %q, want %q", tt.path, tt.root, rel, tt.rel)
+		}
+		if got := syncPath(tt.root, rel, tt.mount, tt.v2); got != tt.path {
+			t.Errorf("syncPath(%q, %q) = %q, want %q", tt.root, rel, got, tt.path)
+		}
+	}
+}
+
+func setRewrites(t *testing.T, prefixes, regexes []string) {
+	t.Helper()
+	noMapFile := ""
+	rewritePrefix, rewriteRegex, rewriteMapFile = stringList(prefixes), stringList(regexes), &noMapFile
+	if err := loadRewriteRules(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	kvMountPath, kvApi, dstMountPath, dstKvApi = "secret", true, "kv", false
+	defer func() { kvMountPath, kvApi, dstMountPath, dstKvApi = "", false, "", false }()
+	setRewrites(t, []string{"secret/skydrivedev=kv/teams/skydrive"}, []string{`secret/(\w+)/dev/(.*)=kv/$1/$2`})
+	defer setRewrites(t, nil, nil)
+	rewriteMap["secret/one"] = "kv/other/one"
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"secret/data/one", "kv/other/one"},
+		{"secret/data/skydrivedev/a", "kv/teams/skydrive/a"},
+		{"secret/data/skydrivedev", "kv/teams/skydrive"},
+		{"secret/data/skydrivedevx/a", "secret/skydrivedevx/a"},
+		{"secret/data/app/dev/x/y", "kv/app/x/y"},
+		{"secret/data/a/b/dev/x", "secret/a/b/dev/x"},
+		{"secret/data/app/devx", "secret/app/devx"},
+	}
+	for _, tt := range tests {
+		if got := rewritePath(tt.path); got != tt.want {
+			t.Errorf("rewritePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRewrites(t *testing.T) {
+	var once time.Duration
+	watch = &once
+	setRewrites(t, []string{"secret/a=secret/c", "secret/b=secret/c"}, nil)
+	defer setRewrites(t, nil, nil)
+
+	if err := checkRewrites([]string{"secret/a/x", "secret/b/y"}); err != nil {
+		t.Errorf("checkRewrites without collisions: %s", err)
+	}
+	err := checkRewrites([]string{"secret/a/x", "secret/b/x", "secret/c/x"})
+	if err == nil || !strings.Contains(err.Error(), "secret/c/x <- secret/a/x, secret/b/x, secret/c/x") {
+		t.Errorf("checkRewrites with collisions = %v", err)
+	}
+}
+
+func TestKeyDiff(t *testing.T) {
+	mode := "clear"
+	diffValues = &mode
+	tests := []struct {
+		a, b map[string]interface{}
+		want []KeyDiff
+	}{
+		{map[string]interface{}{"x": "1"}, map[string]interface{}{"x": "1"}, nil},
+		{nil, map[string]interface{}{"x": "1"}, []KeyDiff{{Key: "x", Change: "added", To: "1"}}},
+		{map[string]interface{}{"x": "1"}, nil, []KeyDiff{{Key: "x", Change: "removed", From: "1"}}},
+		{
+			map[string]interface{}{"b": "1", "a": "old", "n": 1.0},
+			map[string]interface{}{"a": "new", "c": true, "n": 1.0},
+			[]KeyDiff{
+				{Key: "a", Change: "changed", From: "old", To: "new"},
+				{Key: "b", Change: "removed", From: "1"},
+				{Key: "c", Change: "added", To: "true"},
+			},
+		},
+		{map[string]interface{}{"x": "1"}, map[string]interface{}{"x": 1.0}, nil}, // equal as strings
+	}
+	for _, tt := range tests {
+		if got := keyDiff(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("keyDiff(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	mode, salt := "", "pepper"
+	diffValues, diffSalt = &mode, &salt
+	sum := sha256.Sum256([]byte("pepper" + "s3cret"))
+	tests := []struct {
+		mode  string
+		value interface{}
+		want  string
+	}{
+		{"clear", "s3cret", "s3cret"},
+		{"clear", map[string]interface{}{"a": 1.0}, `{"a":1}`},
+		{"mask", "s3cret", "s****"},
+		{"mask", "abc", "****"},
+		{"mask", "a-very-long-password", "a-v****"},
+		{"hash", "s3cret", "sha256:" + hex.EncodeToString(sum[:])[:12]},
+	}
+	for _, tt := range tests {
+		mode = tt.mode
+		if got := redact(tt.value); got != tt.want {
+			t.Errorf("redact(%v) with %s = %q, want %q", tt.value, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestOpenJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vaultcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "journal")
+	journalFile = &name
+
+	tests := []struct {
+		journal string
+		resume  bool
+		want    map[string]bool
+	}{
+		{"", true, map[string]bool{}},
+		{"done write secret/data/a\n", false, map[string]bool{}},
+		{"done write secret/data/a\ndone delete secret/data/b\n", true,
+			map[string]bool{"write secret/data/a": true, "delete secret/data/b": true}},
+		{"fail write secret/data/a Error: 503\n", true, map[string]bool{"write secret/data/a": false}},
+		{"fail write secret/data/a Error: 503\ndone write secret/data/a\n", true, map[string]bool{"write secret/data/a": true}},
+		{"done write secret/data/a\nfail write secret/data/a Error: 503\n", true, map[string]bool{"write secret/data/a": false}},
+		{"done write secret/data/a with spaces\n", true, map[string]bool{"write secret/data/a": true}},
+		{"garbage\ndone write secret/data/a\n", true, map[string]bool{"write secret/data/a": true}},
+		{"done write secret/data/a\ndone write secret/da", true, map[string]bool{"write secret/data/a": true}}, // cut short
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(name, []byte(tt.journal), 0600); err != nil {
+			t.Fatal(err)
+		}
+		resume = &tt.resume
+		if err := openJournal(); err != nil {
+			t.Fatalf("openJournal(%q): %s", tt.journal, err)
+		}
+		journalRecord("delete", "secret/data/c", nil)
+		closeJournal()
+		if !reflect.DeepEqual(journalDone, tt.want) {
+			t.Errorf("openJournal(%q) with resume %v = %v, want %v", tt.journal, tt.resume, journalDone, tt.want)
+		}
+
+		ba, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "done delete secret/data/c\n"
+		switch {
+		case tt.resume && tt.journal != "" && !strings.HasSuffix(tt.journal, "\n"):
+			want = tt.journal + "\n" + want
+		case tt.resume:
+			want = tt.journal + want
+		}
+		if string(ba) != want {
+			t.Errorf("journal of %q with resume %v = %q, want %q", tt.journal, tt.resume, ba, want)
+		}
+	}
+}
+
+// fakeKV is a kv v2 secret of a fake Vault whose first write can fail with a 503, either before or after applying it
+type fakeKV struct {
+	current int
+	writes  int
+	fail    string // "", "before" or "after" the first write is applied
+}
+
+func (f *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/"):
+		if f.current == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"current_version": f.current}})
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		var body struct {
+			Options map[string]int `json:"options"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.writes++
+		if f.writes == 1 && f.fail == "before" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if cas, ok := body.Options["cas"]; !ok || cas != f.current {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"check-and-set parameter did not match the current version"}})
+			return
+		}
+		f.current++
+		if f.writes == 1 && f.fail == "after" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"version": f.current}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestWriteVersion(t *testing.T) {
+	attempts, base, jitter, noTimeout := 3, time.Millisecond, 0.0, time.Duration(0)
+	retryMaxAttempts, retryBaseBackoff, retryMaxBackoff, retryJitter = &attempts, &base, &base, &jitter
+	listTimeout, readTimeout, writeTimeout = &noTimeout, &noTimeout, &noTimeout
+	dstMountPath = "secret"
+	defer func() { dstMountPath = "" }()
+
+	tests := []struct {
+		current    int
+		fail       string
+		wantVer    int
+		wantWrites int
+	}{
+		{0, "", 1, 1},
+		{3, "", 4, 1},
+		{0, "before", 1, 2}, // the failed write was not applied so it is written again
+		{0, "after", 1, 1},  // the failed write was applied so its version is taken
+		{2, "after", 3, 1},
+	}
+	for _, tt := range tests {
+		f := &fakeKV{current: tt.current, fail: tt.fail}
+		server := httptest.NewServer(f)
+		rateLimiters = nil
+		client, err := newClient(server.URL, "t", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ver, err := writeVersion(context.Background(), client, "secret/data/a", map[string]interface{}{"x": "1"})
+		server.Close()
+		if err != nil {
+			t.Errorf("writeVersion from version %d failing %q: %s", tt.current, tt.fail, err)
+			continue
+		}
+		if ver != tt.wantVer || f.writes != tt.wantWrites || f.current != tt.wantVer {
+			t.Errorf("writeVersion from version %d failing %q = version %d with %d writes (current %d), want version %d with %d writes",
+				tt.current, tt.fail, ver, f.writes, f.current, tt.wantVer, tt.wantWrites)
+		}
+	}
+}
+
+func TestMergeListings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vaultcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst, out := filepath.Join(dir, "src.out"), filepath.Join(dir, "dst.out"), filepath.Join(dir, "merged.out")
+	precedence, inputVersion, once := "", 2, time.Duration(0)
+	srcInputFile, dstInputFile, listOutputFile = &src, &dst, &out
+	mergePrecedence, srcInputKvVersion, watch = &precedence, &inputVersion, &once
+	setFilters(t)
+
+	tests := []struct {
+		name       string
+		src        string
+		dst        string
+		precedence string
+		want       string // the merged file, or the start of the error when wantErr is set
+		wantErr    bool
+	}{
+		{
+			name: "union without mount lines",
+			src:  "secret/data/a {\"x\":\"1\"}\nsecret/data/c {\"z\":\"3\"}\n",
+			dst:  "secret/data/b {\"y\":\"2\"}\n",
+			want: "secret/data/a {\"x\":\"1\"}\nsecret/data/b {\"y\":\"2\"}\nsecret/data/c {\"z\":\"3\"}\n",
+		},
+		{
+			name:       "source precedence",
+			src:        "secret/data/a {\"x\":\"src\"}\n",
+			dst:        "secret/data/a {\"x\":\"dst\"}\n",
+			precedence: "source",
+			want:       "secret/data/a {\"x\":\"src\"}\n",
+		},
+		{
+			name:       "destination precedence",
+			src:        "secret/data/a {\"x\":\"src\"}\n",
+			dst:        "secret/data/a {\"x\":\"dst\"}\n",
+			precedence: "destination",
+			want:       "secret/data/a {\"x\":\"dst\"}\n",
+		},
+		{
+			name: "mounts in source order then the destination only mounts",
+			src:  "# mount secret/ v2\nsecret/data/a {\"x\":\"1\"}\n",
+			dst:  "# mount legacy/ v1\nlegacy/k {\"o\":\"1\"}\n# mount secret/ v2\nsecret/data/b {\"y\":\"2\"}\n",
+			want: "# mount secret/ v2\nsecret/data/a {\"x\":\"1\"}\nsecret/data/b {\"y\":\"2\"}\n# mount legacy/ v1\nlegacy/k {\"o\":\"1\"}\n",
+		},
+		{
+			name:    "only the source has mount lines",
+			src:     "# mount secret/ v2\nsecret/data/a {\"x\":\"1\"}\n",
+			dst:     "secret/data/a {\"x\":\"1\"}\n",
+			want:    "Error: only one of",
+			wantErr: true,
+		},
+		{
+			name:    "only the destination has mount lines",
+			src:     "secret/data/a {\"x\":\"1\"}\n",
+			dst:     "# mount secret/ v2\nsecret/data/a {\"x\":\"1\"}\n",
+			want:    "Error: only one of",
+			wantErr: true,
+		},
+		{
+			name:    "kv versions differ",
+			src:     "# mount secret/ v2\nsecret/data/a {\"x\":\"1\"}\n",
+			dst:     "# mount secret/ v1\nsecret/a {\"x\":\"1\"}\n",
+			want:    "Error: mount secret/ is kv v2",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(src, []byte(tt.src), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dst, []byte(tt.dst), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(out)
+		precedence = tt.precedence
+		if precedence == "" {
+			precedence = "source"
+		}
+		report = newReport()
+
+		err := mergeListings()
+		if tt.wantErr {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("%s: mergeListings() = %v, want an error starting with %q", tt.name, err, tt.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: mergeListings(): %s", tt.name, err)
+			continue
+		}
+		ba, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ba) != tt.want {
+			t.Errorf("%s: merged\n%s\nwant\n%s", tt.name, ba, tt.want)
+		}
+	}
+}